@@ -26,31 +26,179 @@ package golibjpegturbo
 #cgo darwin LDFLAGS: -L/usr/local/opt/jpeg-turbo/lib -ljpeg
 #cgo darwin CFLAGS: -I/usr/local/opt/jpeg-turbo/include
 
-#include <stddef.h>
-#include <stdio.h>
-#include <stdlib.h>
-#include <jpeglib.h>
-
-void error_panic(j_common_ptr cinfo);
+#include "jpeg_common.h"
 */
 import "C"
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"image"
+	"image/color"
+	"image/draw"
 	"io"
-	"io/ioutil"
-	"reflect"
+	"runtime"
+	"runtime/cgo"
 	"unsafe"
 )
 
+// errOutOfMemory is returned when allocating libjpeg objects fails
+var errOutOfMemory = errors.New("JPEG error: out of memory")
+
+// readBufferSize is the size of the chunks in which Decode reads compressed
+// data from io.Reader
+const readBufferSize = 32 * 1024
+
+// configReadBufferSize is smaller than readBufferSize because DecodeConfig
+// only needs the header, so we don't want to read much past it
+const configReadBufferSize = 4 * 1024
+
 // JpegInfo contains information about JPEG image.
+// Width and Height are the dimensions of decoded image i.e. after scaling.
+// ImageWidth and ImageHeight are the dimensions of JPEG image.
+//
+// QuantTables are quantization tables defined in the header and
+// QuantTableIndex[i] is the index in QuantTables of the table used by
+// component i. Quality is IJG quality (as used by libjpeg and Options) that
+// results in tables closest to QuantTables.
+//
+// HuffmanTables are Huffman tables defined in the header. Progressive images
+// can define more tables before later scans, those are not included.
+//
+// AdobeMarker is true if the image has Adobe APP14 marker and AdobeTransform
+// is its transform flag: 0 for RGB or CMYK, 1 for YCbCr and 2 for YCCK.
+// CMYK and YCCK images (YCCK is converted to CMYK when decoding) written
+// by Adobe apps, i.e. with Adobe marker, have inverted samples (0 is full
+// ink), which is indicated by InvertedCMYK.
 type JpegInfo struct {
 	Components       int
 	ColorSpace       int
 	Width            int
 	Height           int
+	ImageWidth       int
+	ImageHeight      int
+	ScaleNum         int
+	ScaleDenom       int
 	ColorSpaceString string
+	QuantTables      []QuantTable
+	QuantTableIndex  []int
+	Quality          int
+	HuffmanTables    []HuffmanTable
+	AdobeMarker      bool
+	AdobeTransform   int
+	InvertedCMYK     bool
+}
+
+// DecodeOptions are the decoding parameters.
+//
+// libjpeg-turbo can scale the image while decoding (in DCT domain), which is
+// much faster than decoding full image and resizing it. Supported scaling
+// factors are M/8 for M from 1 to 16. Other ScaleNum/ScaleDenom ratios are
+// rounded up to the nearest supported factor. ScaleDenom of 0 means no scaling.
+//
+// If MinWidth or MinHeight is > 0, ScaleNum/ScaleDenom is ignored and the
+// image is decoded at the smallest scale at which it's at least
+// MinWidth x MinHeight. Images are never scaled up in this mode.
+//
+// libjpeg recovers from corrupt or truncated data by filling in the missing
+// parts of the image and reporting a warning. If Strict is true, warnings
+// are returned as errors instead.
+//
+// MaxWidth, MaxHeight and MaxPixels limit the dimensions of the image (before
+// scaling) and are checked right after reading the header. MaxMemory limits
+// the memory libjpeg can use for buffering the whole image, which is needed
+// for progressive images. MaxScans limits the number of scans of
+// progressive images. Decoding fails with ErrLimitExceeded if a limit
+// is exceeded. 0 means no limit.
+//
+// Progress, if not nil, is called by DecodeContext (and DecodeData and
+// DecodeDataWithOptions) as decoding progresses. It's called often, so it
+// should be fast.
+//
+// If YCbCr is true, YCbCr images are decoded as *image.YCbCr, without color
+// conversion and chroma upsampling, which is faster and keeps the original
+// subsampling. Images that aren't YCbCr or have subsampling image.YCbCr
+// can't represent are decoded as usual. DecodeRegion and DecodeInto ignore
+// YCbCr.
+//
+// PixelFormat is the pixel format of decoded images, see PixelFormat. It
+// takes precedence over YCbCr. DecodeInto ignores it, as the format is
+// given by the destination.
+type DecodeOptions struct {
+	ScaleNum    int
+	ScaleDenom  int
+	MinWidth    int
+	MinHeight   int
+	Strict      bool
+	MaxWidth    int
+	MaxHeight   int
+	MaxPixels   int
+	MaxMemory   int
+	MaxScans    int
+	Progress    func(Progress)
+	YCbCr       bool
+	PixelFormat PixelFormat
+}
+
+// DecodeResult is the result of DecodeDataWithResult.
+//
+// Warnings are the first warnings reported by libjpeg while decoding and
+// NumWarnings is the number of all warnings.
+// ValidScanlines is the number of rows at the top of Image decoded before
+// libjpeg found missing or corrupt data, rows below it may be filled in.
+// Truncated is true if the data ended before the end of the image.
+type DecodeResult struct {
+	Image          image.Image
+	Warnings       []Warning
+	NumWarnings    int
+	ValidScanlines int
+	Truncated      bool
+}
+
+// applyDecodeOptions sets decoding parameters in cinfo. It must be called
+// after jpeg_read_header(). On return, output_width and output_height
+// are valid.
+func applyDecodeOptions(cinfo *C.struct_jpeg_decompress_struct, o *DecodeOptions) error {
+	if o == nil {
+		return calcOutputDimensions(cinfo)
+	}
+	if o.ScaleNum < 0 || o.ScaleDenom < 0 || (o.ScaleDenom > 0 && o.ScaleNum == 0) {
+		return fmt.Errorf("invalid scale %d/%d", o.ScaleNum, o.ScaleDenom)
+	}
+	if o.MinWidth < 0 || o.MinHeight < 0 {
+		return fmt.Errorf("invalid minimum size %dx%d", o.MinWidth, o.MinHeight)
+	}
+	if err := o.PixelFormat.validate(); err != nil {
+		return err
+	}
+	if o.MinWidth > 0 || o.MinHeight > 0 {
+		// libjpeg rounds scaled dimensions up, so the easiest way to get
+		// them exactly right is to ask libjpeg
+		for m := 1; m <= 8; m++ {
+			cinfo.scale_num = C.uint(m)
+			cinfo.scale_denom = 8
+			if err := calcOutputDimensions(cinfo); err != nil {
+				return err
+			}
+			if int(cinfo.output_width) >= o.MinWidth && int(cinfo.output_height) >= o.MinHeight {
+				break
+			}
+		}
+		return nil
+	}
+	if o.ScaleDenom > 0 {
+		cinfo.scale_num = C.uint(o.ScaleNum)
+		cinfo.scale_denom = C.uint(o.ScaleDenom)
+	}
+	return calcOutputDimensions(cinfo)
+}
+
+func calcOutputDimensions(cinfo *C.struct_jpeg_decompress_struct) error {
+	if C.try_calc_output_dimensions(cinfo) == 0 {
+		return jpegError(cinfo.err, PhaseHeader)
+	}
+	return nil
 }
 
 /*
@@ -111,189 +259,248 @@ func colorSpaceToString(cs int) string {
 	return "unknown"
 }
 
-// GetJpegInfo returns information about a JPEG image.
-func GetJpegInfo(d []byte) (info *JpegInfo, err error) {
-	defer func() {
-		if r := recover(); r != nil {
-			info = nil
-			var ok bool
-			err, ok = r.(error)
-			if !ok {
-				err = fmt.Errorf("JPEG error: %v", r)
-			}
-		}
-	}()
-	// those are allocated, not on stack because of
+// newDecompress allocates and initializes libjpeg decompressor. It must be
+// released with destroyDecompress.
+func newDecompress() (*C.struct_jpeg_decompress_struct, error) {
+	// those are allocated from heap, not on stack because of
 	// https://groups.google.com/forum/#!topic/golang-nuts/g4yBziN-MZQ
-	cinfo := (*C.struct_jpeg_decompress_struct)(C.malloc(C.size_t(unsafe.Sizeof(C.struct_jpeg_decompress_struct{}))))
-	defer C.free(unsafe.Pointer(cinfo))
-	cinfo.err = (*C.struct_jpeg_error_mgr)(C.malloc(C.size_t(unsafe.Sizeof(C.struct_jpeg_error_mgr{}))))
-	defer C.free(unsafe.Pointer(cinfo.err))
+	cinfo := (*C.struct_jpeg_decompress_struct)(C.calloc(1, C.size_t(unsafe.Sizeof(C.struct_jpeg_decompress_struct{}))))
+	if cinfo == nil {
+		return nil, errOutOfMemory
+	}
+	cinfo.err = C.alloc_error_mgr()
+	if cinfo.err == nil {
+		C.free(unsafe.Pointer(cinfo))
+		return nil, errOutOfMemory
+	}
+	if C.try_create_decompress(cinfo) == 0 {
+		err := jpegError(cinfo.err, PhaseHeader)
+		destroyDecompress(cinfo)
+		return nil, err
+	}
+	return cinfo, nil
+}
 
-	C.jpeg_std_error(cinfo.err)
-	cinfo.err.error_exit = (*[0]byte)(C.error_panic)
+// destroyDecompress releases cinfo. It's safe to call at any point, including
+// after libjpeg failed with an error.
+func destroyDecompress(cinfo *C.struct_jpeg_decompress_struct) {
+	C.jpeg_destroy_decompress(cinfo)
+	C.free(unsafe.Pointer(cinfo.err))
+	C.free(unsafe.Pointer(cinfo))
+}
 
-	C.jpeg_CreateDecompress(cinfo, C.JPEG_LIB_VERSION, C.size_t(unsafe.Sizeof(C.struct_jpeg_decompress_struct{})))
-	defer C.jpeg_destroy_decompress(cinfo)
+// memSrc sets up cinfo to read compressed data from d. libjpeg keeps
+// a pointer to d between calls, so d is pinned with pinner, which the caller
+// must keep until it's done decoding.
+func memSrc(cinfo *C.struct_jpeg_decompress_struct, d []byte, pinner *runtime.Pinner) error {
+	// libjpeg reports empty input as an error
+	var p *C.uchar
+	if len(d) > 0 {
+		pinner.Pin(&d[0])
+		p = (*C.uchar)(unsafe.Pointer(&d[0]))
+	}
+	if C.try_mem_src(cinfo, p, C.ulong(len(d))) == 0 {
+		return jpegError(cinfo.err, PhaseHeader)
+	}
+	return nil
+}
 
-	// TODO: should make a copy in C memory for GC safety?
-	C.jpeg_mem_src(cinfo, (*C.uchar)(unsafe.Pointer(&d[0])), C.ulong(len(d)))
+// readerSrc sets up cinfo to read compressed data from src in chunks of
+// bufSize. h is the handle to src.
+func readerSrc(cinfo *C.struct_jpeg_decompress_struct, h cgo.Handle, bufSize int) error {
+	if C.try_reader_src(cinfo, C.uintptr_t(h), C.size_t(bufSize)) == 0 {
+		return jpegError(cinfo.err, PhaseHeader)
+	}
+	return nil
+}
 
-	res := C.jpeg_read_header(cinfo, C.TRUE)
-	if res != C.JPEG_HEADER_OK {
-		err = fmt.Errorf("C.jpeg_reader_header() failed with %d", int(res))
-		return
+// GetJpegInfo returns information about a JPEG image.
+func GetJpegInfo(d []byte) (*JpegInfo, error) {
+	return GetJpegInfoWithOptions(d, nil)
+}
+
+// GetJpegInfoWithOptions returns information about a JPEG image, with Width
+// and Height being the dimensions of the image decoded with options o.
+func GetJpegInfoWithOptions(d []byte, o *DecodeOptions) (*JpegInfo, error) {
+	cinfo, err := newDecompress()
+	if err != nil {
+		return nil, err
 	}
-	info = &JpegInfo{}
+	defer destroyDecompress(cinfo)
+
+	var pinner runtime.Pinner
+	defer pinner.Unpin()
+	if err = memSrc(cinfo, d, &pinner); err != nil {
+		return nil, err
+	}
+	// output_width and output_height are only valid after applying options
+	if err = readHeader(cinfo, o); err != nil {
+		return nil, err
+	}
+	info := &JpegInfo{}
 	info.Components = int(cinfo.num_components)
 	info.ColorSpace = int(cinfo.jpeg_color_space)
 	info.Width = int(cinfo.output_width)
 	info.Height = int(cinfo.output_height)
+	info.ImageWidth = int(cinfo.image_width)
+	info.ImageHeight = int(cinfo.image_height)
+	info.ScaleNum = int(cinfo.scale_num)
+	info.ScaleDenom = int(cinfo.scale_denom)
 	info.ColorSpaceString = colorSpaceToString(info.ColorSpace)
-	return
+	info.QuantTables, info.QuantTableIndex = readQuantTables(cinfo)
+	info.Quality = EstimateQuality(info.QuantTables, info.QuantTableIndex)
+	info.HuffmanTables = readHuffmanTables(cinfo)
+	info.AdobeMarker = cinfo.saw_Adobe_marker != 0
+	info.AdobeTransform = int(cinfo.Adobe_transform)
+	info.InvertedCMYK = info.Components == 4 && cmykInverted(cinfo)
+	return info, nil
 }
 
-func decodeToGray(cinfo *C.struct_jpeg_decompress_struct) image.Image {
-	dx := int(cinfo.output_width)
-	nBytes := dx // per one line, 1 byte per pixel
-	dy := int(cinfo.output_height)
-	img := image.NewGray(image.Rect(0, 0, dx, dy))
-
-	// Note: for even greater speed we could decode directly into img.Pix
-	// but that might stop working when moving GC happens
-	bufBytes := C.malloc(C.size_t(nBytes))
-	scanlines := C.JSAMPARRAY(unsafe.Pointer(&bufBytes))
-	buf := sliceFromCBytes(bufBytes, nBytes)
-
-	for y := 0; y < dy; y++ {
-		C.jpeg_read_scanlines(cinfo, scanlines, 1)
-		off := y * img.Stride
-		copy(img.Pix[off:off+nBytes], buf)
+// readRows reads dy scanlines straight into pix, whose rows are stride bytes
+// apart. Row pointers are kept in lb.
+func readRows(cinfo *C.struct_jpeg_decompress_struct, pix []byte, stride, dy int, lb *lineBuffer) error {
+	// libjpeg writes to pix, so it must not be moved by GC while it does
+	var pinner runtime.Pinner
+	pinner.Pin(&pix[0])
+	defer pinner.Unpin()
+
+	// row pointers are stored as uintptr because Go pointers written to C
+	// memory would confuse GC's write barrier
+	rowsMem := lb.get(dy * int(unsafe.Sizeof(uintptr(0))))
+	rows := unsafe.Slice((*uintptr)(rowsMem), dy)
+	for y := range rows {
+		rows[y] = uintptr(unsafe.Pointer(&pix[y*stride]))
+	}
+	var n C.JDIMENSION
+	if C.try_read_scanlines(cinfo, C.JSAMPARRAY(rowsMem), C.JDIMENSION(dy), &n) == 0 {
+		return jpegError(cinfo.err, PhaseDecompress)
 	}
-	C.free(bufBytes)
-	return img
+	if int(n) != dy {
+		return fmt.Errorf("read %d scanlines, expected %d", n, dy)
+	}
+	return nil
 }
 
-// based on https://code.google.com/p/go-wiki/wiki/cgo
-// The important thing is that it creates []byte slice without copying
+// sliceFromCBytes creates []byte slice backed by C memory, without copying
 // memory, for speed
 func sliceFromCBytes(p unsafe.Pointer, size int) []byte {
-	hdr := reflect.SliceHeader{
-		Data: uintptr(p),
-		Len:  size,
-		Cap:  size,
-	}
-	slice := *(*[]byte)(unsafe.Pointer(&hdr))
-	return slice
-}
-
-// Note: for YCbCr could try to stay within YCbCr space, which might make the
-// decode->resize->encode loop faster if we avoid conversion to RGBA at any point
-// However, decoding to YCbCr is more complicated, because it has multiple
-// variants (4:2:2 etc.)
-func decodeToRgba(cinfo *C.struct_jpeg_decompress_struct) image.Image {
-	dx := int(cinfo.output_width)
-	nBytes := dx * 4 // per one line, 4 bytes of destination rgba per pixel
-	dy := int(cinfo.output_height)
-	img := image.NewRGBA(image.Rect(0, 0, dx, dy))
-
-	// Note: for even greater speed we could decode directly into img.Pix
-	// but that might stop working when moving GC happens
-	bufBytes := C.malloc(C.size_t(nBytes))
-	scanlines := C.JSAMPARRAY(unsafe.Pointer(&bufBytes))
-	buf := sliceFromCBytes(bufBytes, nBytes)
-
-	for y := 0; y < dy; y++ {
-		C.jpeg_read_scanlines(cinfo, scanlines, 1)
-		off := y * img.Stride
-		copy(img.Pix[off:off+nBytes], buf)
-	}
-
-	C.free(bufBytes)
-	return img
+	return unsafe.Slice((*byte)(p), size)
 }
 
-// Source is 'Inverted CMYK'
+// cmykInverted returns true if CMYK (or YCCK) image being decoded has
+// 'Inverted CMYK' samples, i.e. 0 is full ink. Adobe apps write such files
+// and mark them with Adobe APP14 marker, so that's what we go by.
 // See https://github.com/google/skia/blob/master/src/images/SkImageDecoder_libjpeg.cpp#L340
 // for explanation
-func decodeCmykToRgba(cinfo *C.struct_jpeg_decompress_struct) image.Image {
-	dx := int(cinfo.output_width)
-	nBytes := dx * 4 // per one line, 4 bytes of destination rgba per pixel
-	dy := int(cinfo.output_height)
-	img := image.NewRGBA(image.Rect(0, 0, dx, dy))
+func cmykInverted(cinfo *C.struct_jpeg_decompress_struct) bool {
+	return cinfo.saw_Adobe_marker != 0
+}
 
-	bufBytes := C.malloc(C.size_t(nBytes))
-	scanlines := C.JSAMPARRAY(unsafe.Pointer(&bufBytes))
-	buf := sliceFromCBytes(bufBytes, nBytes)
+// cmykToRGB converts CMYK color to RGB with the naive c*k/255 formula,
+// which is what libjpeg-based decoders usually do
+func cmykToRGB(c, m, y, k uint8, inverted bool) (uint8, uint8, uint8) {
+	if !inverted {
+		c, m, y, k = 255-c, 255-m, 255-y, 255-k
+	}
+	return uint8(uint32(c) * uint32(k) / 255), uint8(uint32(m) * uint32(k) / 255), uint8(uint32(y) * uint32(k) / 255)
+}
 
+// cmykToRgba converts dx x dy CMYK pixels in pix, whose rows are stride
+// bytes apart, to RGBA in place. inverted is from cmykInverted.
+func cmykToRgba(pix []byte, stride, dx, dy int, inverted bool) {
 	for y := 0; y < dy; y++ {
-		C.jpeg_read_scanlines(cinfo, scanlines, 1)
-		off := y * img.Stride
-		srcOff := 0
-		for x := 0; x < dx; x++ {
-			c := uint32(buf[srcOff])
-			srcOff++
-			m := uint32(buf[srcOff])
-			srcOff++
-			y := uint32(buf[srcOff])
-			srcOff++
-			k := uint32(buf[srcOff])
-			srcOff++
-
-			r := uint8(c * k / 255)
-			g := uint8(m * k / 255)
-			b := uint8(y * k / 255)
-
-			img.Pix[off] = r
-			off++
-			img.Pix[off] = g
-			off++
-			img.Pix[off] = b
-			off++
-			img.Pix[off] = 255
-			off++
+		p := pix[y*stride : y*stride+dx*4]
+		for off := 0; off < len(p); off += 4 {
+			p[off], p[off+1], p[off+2] = cmykToRGB(p[off], p[off+1], p[off+2], p[off+3], inverted)
+			p[off+3] = 255
 		}
 	}
-	C.free(bufBytes)
-	return img
 }
 
-// DecodeData reads JPEG image from d and returns it as an image.Image.
-func DecodeData(d []byte) (img image.Image, err error) {
-	defer func() {
-		if r := recover(); r != nil {
-			img = nil
-			var ok bool
-			err, ok = r.(error)
-			if !ok {
-				err = fmt.Errorf("JPEG error: %v", r)
-			}
+// invertCMYK converts 'Inverted CMYK' dx x dy pixels in pix, whose rows are
+// stride bytes apart, to regular CMYK (as in image.CMYK) in place
+func invertCMYK(pix []byte, stride, dx, dy int) {
+	for y := 0; y < dy; y++ {
+		p := pix[y*stride : y*stride+dx*4]
+		for i, v := range p {
+			p[i] = 255 - v
 		}
-	}()
+	}
+}
 
-	// those are allocated from heap, not on stack because of
-	// https://groups.google.com/forum/#!topic/golang-nuts/g4yBziN-MZQ
-	cinfo := (*C.struct_jpeg_decompress_struct)(C.malloc(C.size_t(unsafe.Sizeof(C.struct_jpeg_decompress_struct{}))))
-	defer C.free(unsafe.Pointer(cinfo))
-	cinfo.err = (*C.struct_jpeg_error_mgr)(C.malloc(C.size_t(unsafe.Sizeof(C.struct_jpeg_error_mgr{}))))
-	defer C.free(unsafe.Pointer(cinfo.err))
+// readHeader reads the header and applies options o
+func readHeader(cinfo *C.struct_jpeg_decompress_struct, o *DecodeOptions) error {
+	setStrict(cinfo.err, o != nil && o.Strict)
+	if err := setLimits(cinfo, o); err != nil {
+		return err
+	}
+	var res C.int
+	if C.try_read_header(cinfo, &res) == 0 {
+		return jpegError(cinfo.err, PhaseHeader)
+	}
+	if res != C.JPEG_HEADER_OK {
+		return fmt.Errorf("%w: C.jpeg_read_header() failed with %d", ErrTruncated, int(res))
+	}
+	if err := checkLimits(cinfo, o); err != nil {
+		return err
+	}
+	return applyDecodeOptions(cinfo, o)
+}
 
-	C.jpeg_std_error(cinfo.err)
-	cinfo.err.error_exit = (*[0]byte)(C.error_panic)
+// setLimits sets up the limits from o that libjpeg enforces while decoding
+func setLimits(cinfo *C.struct_jpeg_decompress_struct, o *DecodeOptions) error {
+	if o == nil {
+		return nil
+	}
+	if o.MaxWidth < 0 || o.MaxHeight < 0 || o.MaxPixels < 0 || o.MaxMemory < 0 || o.MaxScans < 0 {
+		return fmt.Errorf("invalid limits %dx%d, %d pixels, %d bytes, %d scans", o.MaxWidth, o.MaxHeight, o.MaxPixels, o.MaxMemory, o.MaxScans)
+	}
+	if o.MaxMemory > 0 {
+		cinfo.mem.max_memory_to_use = C.long(o.MaxMemory)
+	}
+	if o.MaxScans > 0 {
+		progress, err := progressMgr(C.j_common_ptr(unsafe.Pointer(cinfo)), PhaseHeader)
+		if err != nil {
+			return err
+		}
+		progress.max_scans = C.int(o.MaxScans)
+	}
+	return nil
+}
 
-	C.jpeg_CreateDecompress(cinfo, C.JPEG_LIB_VERSION, C.size_t(unsafe.Sizeof(C.struct_jpeg_decompress_struct{})))
-	defer C.jpeg_destroy_decompress(cinfo)
+// checkLimits checks the image dimensions read from the header against
+// the limits in o
+func checkLimits(cinfo *C.struct_jpeg_decompress_struct, o *DecodeOptions) error {
+	if o == nil {
+		return nil
+	}
+	dx, dy := int(cinfo.image_width), int(cinfo.image_height)
+	if (o.MaxWidth > 0 && dx > o.MaxWidth) || (o.MaxHeight > 0 && dy > o.MaxHeight) {
+		return fmt.Errorf("%w: image size %dx%d, the limit is %dx%d", ErrLimitExceeded, dx, dy, o.MaxWidth, o.MaxHeight)
+	}
+	if o.MaxPixels > 0 && dx*dy > o.MaxPixels {
+		return fmt.Errorf("%w: image has %d pixels, the limit is %d", ErrLimitExceeded, dx*dy, o.MaxPixels)
+	}
+	return nil
+}
 
-	// TODO: should make a copy in C memory for GC safety?
-	C.jpeg_mem_src(cinfo, (*C.uchar)(unsafe.Pointer(&d[0])), C.ulong(len(d)))
+// numComponents returns the number of components of the image, which must
+// be one we can decode
+func numComponents(cinfo *C.struct_jpeg_decompress_struct) (int, error) {
+	nComp := int(cinfo.num_components)
+	if nComp != 1 && nComp != 3 && nComp != 4 {
+		return 0, fmt.Errorf("%w: invalid number of components (%d)", ErrUnsupportedColorSpace, cinfo.num_components)
+	}
+	return nComp, nil
+}
 
-	res := C.jpeg_read_header(cinfo, C.TRUE)
-	if res != C.JPEG_HEADER_OK {
-		img = nil
-		err = fmt.Errorf("C.jpeg_reader_header() failed with %d", int(res))
-		return
+// startDecompress starts decompression to pixel format f after the header
+// has been read. It returns the number of components.
+func startDecompress(cinfo *C.struct_jpeg_decompress_struct, f PixelFormat) (int, error) {
+	nComp, err := numComponents(cinfo)
+	if err != nil {
+		return 0, err
 	}
-	nComp := int(cinfo.num_components)
 
 	// if we're decoding YCbCr image, ask libjpeg to decode directly to RGBA
 	// for speed (as opposed to converting to RGB and doing RGB -> RGBA in Go)
@@ -303,29 +510,491 @@ func DecodeData(d []byte) (img image.Image, err error) {
 	if nComp == 3 {
 		cinfo.out_color_space = C.JCS_EXT_RGBA
 	}
+	// CMYK is decoded as is and converted in Go, other images are decoded
+	// as RGBA and converted to CMYK in Go
+	if f != PixelFormatDefault && nComp != 4 {
+		cinfo.out_color_space = pixelFormats[f].colorSpace
+		if f == PixelFormatCMYK {
+			cinfo.out_color_space = C.JCS_EXT_RGBA
+		}
+	}
 
-	C.jpeg_start_decompress(cinfo)
-	defer C.jpeg_finish_decompress(cinfo)
+	if C.try_start_decompress(cinfo) == 0 {
+		return 0, jpegError(cinfo.err, PhaseDecompress)
+	}
+	return nComp, nil
+}
 
-	if nComp == 1 {
-		img = decodeToGray(cinfo)
-	} else if nComp == 3 {
-		img = decodeToRgba(cinfo)
-	} else if nComp == 4 {
-		img = decodeCmykToRgba(cinfo)
+// readScanlines reads r.Dy() scanlines and returns them as an image with
+// bounds r. x0 is the offset of r.Min.X within a scanline. Images are
+// returned in pixel format f, by default grayscale images as *image.Gray,
+// others as *image.RGBA.
+//
+// libjpeg decodes straight into the returned image. When it's cropped, its
+// scanlines are wider than r, so it's a sub-image of a wider image.
+func readScanlines(cinfo *C.struct_jpeg_decompress_struct, nComp int, f PixelFormat, r image.Rectangle, x0 int, lb *lineBuffer) (image.Image, error) {
+	minX := r.Min.X - x0
+	full := image.Rect(minX, r.Min.Y, minX+int(cinfo.output_width), r.Max.Y)
+	decoded := f
+	switch {
+	case nComp == 4:
+		// YCCK is converted to CMYK by libjpeg
+		decoded = PixelFormatCMYK
+	case f == PixelFormatDefault && nComp == 1:
+		decoded = PixelFormatGray
+	case f == PixelFormatDefault || f == PixelFormatCMYK:
+		decoded = PixelFormatRGBA
+	}
+	img, pix, stride := newDecodedImage(decoded, full)
+	if err := readRows(cinfo, pix, stride, r.Dy(), lb); err != nil {
+		return nil, err
+	}
+	switch {
+	case nComp == 4 && f == PixelFormatCMYK:
+		if cmykInverted(cinfo) {
+			invertCMYK(pix, stride, full.Dx(), full.Dy())
+		}
+	case nComp == 4:
+		// converted to RGBA in place
+		cmykToRgba(pix, stride, full.Dx(), full.Dy(), cmykInverted(cinfo))
+		img = &image.RGBA{Pix: pix, Stride: stride, Rect: full}
+		if f != PixelFormatDefault && f != PixelFormatRGBA {
+			img = convertRGBA(img.(*image.RGBA), f)
+		}
+	case f == PixelFormatCMYK:
+		img = convertRGBA(img.(*image.RGBA), f)
+	}
+	if full != r {
+		return img.(interface {
+			SubImage(image.Rectangle) image.Image
+		}).SubImage(r), nil
+	}
+	return img, nil
+}
+
+// decompress decodes an image from cinfo, whose source manager has already
+// been set up
+func decompress(cinfo *C.struct_jpeg_decompress_struct, o *DecodeOptions, lb *lineBuffer) (image.Image, error) {
+	if err := readHeader(cinfo, o); err != nil {
+		return nil, err
+	}
+	var img image.Image
+	f := PixelFormatDefault
+	if o != nil {
+		f = o.PixelFormat
+	}
+	if ratio, ok := ycbcrRatio(cinfo); o != nil && o.YCbCr && f == PixelFormatDefault && ok {
+		m, err := decodeYCbCr(cinfo, ratio)
+		if err != nil {
+			return nil, err
+		}
+		img = m
 	} else {
-		err = fmt.Errorf("Invalid number of components (%d)", cinfo.num_components)
+		nComp, err := startDecompress(cinfo, f)
+		if err != nil {
+			return nil, err
+		}
+		r := image.Rect(0, 0, int(cinfo.output_width), int(cinfo.output_height))
+		img, err = readScanlines(cinfo, nComp, f, r, 0, lb)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if C.try_finish_decompress(cinfo) == 0 {
+		return nil, jpegError(cinfo.err, PhaseDecompress)
 	}
-	return
+	return img, nil
+}
+
+// DecodeData reads JPEG image from d and returns it as an image.Image.
+func DecodeData(d []byte) (image.Image, error) {
+	return DecodeDataWithOptions(d, nil)
+}
+
+// DecodeDataWithOptions reads JPEG image from d and returns it as an
+// image.Image, decoded with options o.
+func DecodeDataWithOptions(d []byte, o *DecodeOptions) (image.Image, error) {
+	return DecodeContext(context.Background(), d, o)
+}
+
+// DecodeContext reads JPEG image from d and returns it as an image.Image,
+// decoded with options o. Decoding is aborted when ctx is done, in which
+// case ctx.Err() is returned.
+func DecodeContext(ctx context.Context, d []byte, o *DecodeOptions) (image.Image, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	dec, err := NewDecoder()
+	if err != nil {
+		return nil, err
+	}
+	defer dec.Close()
+	return dec.DecodeContext(ctx, d, o)
+}
+
+// Decoder decodes JPEG images, keeping libjpeg decompressor and buffers
+// between calls. When decoding many images, it's faster than DecodeData
+// which sets them up for every image.
+//
+// Decoder is not safe for concurrent use, but it can be kept per goroutine
+// or in a sync.Pool. It must be released with Close.
+//
+// Like libjpeg decompressor, Decoder keeps quantization and Huffman tables
+// between images, so an image without them (abbreviated datastream) is
+// decoded with the tables of a previous image.
+type Decoder struct {
+	cinfo *C.struct_jpeg_decompress_struct
+	buf   lineBuffer
+	// libjpeg's default, restored after decoding with DecodeOptions.MaxMemory
+	maxMemory C.long
+}
+
+// NewDecoder returns a new Decoder.
+func NewDecoder() (*Decoder, error) {
+	cinfo, err := newDecompress()
+	if err != nil {
+		return nil, err
+	}
+	return &Decoder{cinfo: cinfo, maxMemory: cinfo.mem.max_memory_to_use}, nil
+}
+
+// Close releases libjpeg decompressor and buffers. The Decoder can't be used
+// after that.
+func (dec *Decoder) Close() {
+	if dec.cinfo != nil {
+		destroyDecompress(dec.cinfo)
+		dec.cinfo = nil
+	}
+	dec.buf.free()
+}
+
+// reset makes the decompressor ready for decoding the next image
+func (dec *Decoder) reset() {
+	C.jpeg_abort_decompress(dec.cinfo)
+	dec.cinfo.mem.max_memory_to_use = dec.maxMemory
+	if dec.cinfo.progress != nil {
+		(*C.go_progress_mgr)(unsafe.Pointer(dec.cinfo.progress)).max_scans = 0
+	}
+}
+
+// Decode reads JPEG image from d and returns it as an image.Image, decoded
+// with options o.
+func (dec *Decoder) Decode(d []byte, o *DecodeOptions) (image.Image, error) {
+	return dec.DecodeContext(context.Background(), d, o)
+}
+
+// DecodeContext is like Decode but decoding is aborted when ctx is done, in
+// which case ctx.Err() is returned.
+func (dec *Decoder) DecodeContext(ctx context.Context, d []byte, o *DecodeOptions) (image.Image, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	cinfo := dec.cinfo
+	defer dec.reset()
+
+	var pinner runtime.Pinner
+	defer pinner.Unpin()
+	if err := memSrc(cinfo, d, &pinner); err != nil {
+		return nil, err
+	}
+	var fn func(Progress)
+	if o != nil {
+		fn = o.Progress
+	}
+	m, err := watchProgress(C.j_common_ptr(unsafe.Pointer(cinfo)), ctx, fn, PhaseHeader)
+	if err != nil {
+		return nil, err
+	}
+	if m == nil {
+		return decompress(cinfo, o, &dec.buf)
+	}
+	defer m.release()
+	img, err := decompress(cinfo, o, &dec.buf)
+	if m.err != nil {
+		// libjpeg was aborted because ctx is done
+		return nil, m.err
+	}
+	return img, err
+}
+
+// DecodeInto decodes JPEG image from d, with options o, into dst at point
+// at, without allocating a new image. dst must be large enough for the
+// decoded image. It returns the rectangle of dst the image was written to.
+//
+// libjpeg decodes straight into *image.RGBA, *image.NRGBA and *image.Gray
+// (except CMYK images), other images are drawn with draw.Draw.
+func DecodeInto(dst draw.Image, at image.Point, d []byte, o *DecodeOptions) (image.Rectangle, error) {
+	dec, err := NewDecoder()
+	if err != nil {
+		return image.Rectangle{}, err
+	}
+	defer dec.Close()
+	return dec.DecodeInto(dst, at, d, o)
+}
+
+// DecodeInto decodes JPEG image from d into dst at point at, like the
+// package-level DecodeInto.
+func (dec *Decoder) DecodeInto(dst draw.Image, at image.Point, d []byte, o *DecodeOptions) (image.Rectangle, error) {
+	cinfo := dec.cinfo
+	defer dec.reset()
+
+	var pinner runtime.Pinner
+	defer pinner.Unpin()
+	if err := memSrc(cinfo, d, &pinner); err != nil {
+		return image.Rectangle{}, err
+	}
+	if err := readHeader(cinfo, o); err != nil {
+		return image.Rectangle{}, err
+	}
+	size := image.Pt(int(cinfo.output_width), int(cinfo.output_height))
+	r := image.Rectangle{Min: at, Max: at.Add(size)}
+	if !r.In(dst.Bounds()) {
+		return image.Rectangle{}, fmt.Errorf("%w: %dx%d image at %v doesn't fit in destination %v", ErrInvalidDimensions, size.X, size.Y, at, dst.Bounds())
+	}
+	nComp, err := numComponents(cinfo)
+	if err != nil {
+		return image.Rectangle{}, err
+	}
+
+	// pixels of dst within r, if libjpeg can decode straight into it.
+	// CMYK is decoded as is and converted in place.
+	var pix []byte
+	var stride int
+	rgbaSpace := C.J_COLOR_SPACE(C.JCS_EXT_RGBA)
+	if nComp == 4 {
+		rgbaSpace = C.JCS_CMYK
+	}
+	switch v := dst.(type) {
+	case *image.RGBA:
+		sub := v.SubImage(r).(*image.RGBA)
+		pix, stride = sub.Pix, sub.Stride
+		cinfo.out_color_space = rgbaSpace
+	case *image.NRGBA:
+		// decoded pixels are opaque so it's the same as RGBA
+		sub := v.SubImage(r).(*image.NRGBA)
+		pix, stride = sub.Pix, sub.Stride
+		cinfo.out_color_space = rgbaSpace
+	case *image.Gray:
+		// libjpeg can't convert CMYK to grayscale
+		if nComp != 4 {
+			sub := v.SubImage(r).(*image.Gray)
+			pix, stride = sub.Pix, sub.Stride
+			cinfo.out_color_space = C.JCS_GRAYSCALE
+		}
+	}
+	if pix == nil {
+		if _, err = startDecompress(cinfo, PixelFormatDefault); err != nil {
+			return image.Rectangle{}, err
+		}
+		img, err := readScanlines(cinfo, nComp, PixelFormatDefault, image.Rectangle{Max: size}, 0, &dec.buf)
+		if err != nil {
+			return image.Rectangle{}, err
+		}
+		draw.Draw(dst, r, img, image.Point{}, draw.Src)
+	} else {
+		if C.try_start_decompress(cinfo) == 0 {
+			return image.Rectangle{}, jpegError(cinfo.err, PhaseDecompress)
+		}
+		if err = readRows(cinfo, pix, stride, size.Y, &dec.buf); err != nil {
+			return image.Rectangle{}, err
+		}
+		if nComp == 4 {
+			cmykToRgba(pix, stride, size.X, size.Y, cmykInverted(cinfo))
+		}
+	}
+	if C.try_finish_decompress(cinfo) == 0 {
+		return image.Rectangle{}, jpegError(cinfo.err, PhaseDecompress)
+	}
+	return r, nil
+}
+
+// DecodeDataWithResult reads JPEG image from d, decoded with options o, and
+// returns it along with the warnings reported by libjpeg.
+//
+// Unless o.Strict is set, images with corrupt or truncated data are decoded
+// as well as possible and DecodeResult tells how much of the image is valid.
+func DecodeDataWithResult(d []byte, o *DecodeOptions) (*DecodeResult, error) {
+	dec, err := NewDecoder()
+	if err != nil {
+		return nil, err
+	}
+	defer dec.Close()
+	cinfo := dec.cinfo
+
+	var pinner runtime.Pinner
+	defer pinner.Unpin()
+	if err = memSrc(cinfo, d, &pinner); err != nil {
+		return nil, err
+	}
+	img, err := decompress(cinfo, o, &dec.buf)
+	if err != nil {
+		return nil, err
+	}
+	res := &DecodeResult{
+		Image:          img,
+		Warnings:       savedWarnings(cinfo.err),
+		NumWarnings:    int(cinfo.err.num_warnings),
+		ValidScanlines: img.Bounds().Dy(),
+		Truncated:      errorMgr(cinfo.err).truncated != 0,
+	}
+	if n := int(errorMgr(cinfo.err).bad_scanline); n >= 0 && n < res.ValidScanlines {
+		res.ValidScanlines = n
+	}
+	return res, nil
 }
 
 // Decode reads a JPEG image from r and returns it as an image.Image.
+// Compressed data is read from r in chunks as libjpeg needs it, so the
+// whole file is never held in memory and decoding starts before all the data
+// has arrived.
 func Decode(r io.Reader) (image.Image, error) {
-	// loading the whole image is not ideal but doing callbacks is more complicated
-	// so for now do the simple thing
-	d, err := ioutil.ReadAll(r)
+	return DecodeWithOptions(r, nil)
+}
+
+// DecodeWithOptions reads a JPEG image from r and returns it as an
+// image.Image, decoded with options o.
+func DecodeWithOptions(r io.Reader, o *DecodeOptions) (image.Image, error) {
+	dec, err := NewDecoder()
+	if err != nil {
+		return nil, err
+	}
+	defer dec.Close()
+	cinfo := dec.cinfo
+
+	// C code can't hold a Go pointer so it only gets a handle to src
+	src := &readerSource{r: r}
+	h := cgo.NewHandle(src)
+	defer h.Delete()
+	if err = readerSrc(cinfo, h, readBufferSize); err != nil {
+		return nil, err
+	}
+
+	img, err := decompress(cinfo, o, &dec.buf)
+	if src.err != nil {
+		// libjpeg failed because of r, which is more useful to report
+		return nil, src.err
+	}
+	return img, err
+}
+
+// DecodeConfig returns the color model and dimensions of a JPEG image from r
+// without decoding the entire image. Only the header is read from r.
+// The color model matches the type of image returned by Decode.
+func DecodeConfig(r io.Reader) (image.Config, error) {
+	cinfo, err := newDecompress()
+	if err != nil {
+		return image.Config{}, err
+	}
+	defer destroyDecompress(cinfo)
+
+	src := &readerSource{r: r}
+	h := cgo.NewHandle(src)
+	defer h.Delete()
+	if err = readerSrc(cinfo, h, configReadBufferSize); err != nil {
+		return image.Config{}, err
+	}
+
+	err = readHeader(cinfo, nil)
+	if src.err != nil {
+		return image.Config{}, src.err
+	}
+	if err != nil {
+		return image.Config{}, err
+	}
+
+	var cfg image.Config
+	switch int(cinfo.num_components) {
+	case 1:
+		cfg.ColorModel = color.GrayModel
+	case 3, 4:
+		cfg.ColorModel = color.RGBAModel
+	default:
+		return image.Config{}, fmt.Errorf("%w: invalid number of components (%d)", ErrUnsupportedColorSpace, cinfo.num_components)
+	}
+	cfg.Width = int(cinfo.output_width)
+	cfg.Height = int(cinfo.output_height)
+	return cfg, nil
+}
+
+// cropPadding is how many extra pixels to the right of the region we ask
+// jpeg_crop_scanline() for. It's the width of the largest MCU.
+const cropPadding = 16
+
+// checkRegion checks that region r is within the image being decoded
+func checkRegion(cinfo *C.struct_jpeg_decompress_struct, r image.Rectangle) error {
+	bounds := image.Rect(0, 0, int(cinfo.output_width), int(cinfo.output_height))
+	if r.Empty() || !r.In(bounds) {
+		return fmt.Errorf("region %v is empty or outside of image bounds %v", r, bounds)
+	}
+	return nil
+}
+
+// startRegion makes libjpeg decode only region r after decompression has
+// started. It returns the offset of r.Min.X within the decoded scanlines,
+// which start at the first row of r.
+func startRegion(cinfo *C.struct_jpeg_decompress_struct, r image.Rectangle) (int, error) {
+	// libjpeg can only crop at iMCU boundaries so it moves xoff left and
+	// widens width as needed. We skip the extra pixels when copying.
+	// Fancy upsampling of the last column of the cropped region doesn't use
+	// pixels to the right of it, so we ask for a bit more than we need
+	// to get the same pixels as when decoding the whole image.
+	outWidth := int(cinfo.output_width)
+	xoff := C.JDIMENSION(r.Min.X)
+	width := C.JDIMENSION(r.Dx() + cropPadding)
+	if r.Max.X+cropPadding > outWidth {
+		width = C.JDIMENSION(outWidth - r.Min.X)
+	}
+	if C.try_crop_scanline(cinfo, &xoff, &width) == 0 {
+		return 0, jpegError(cinfo.err, PhaseDecompress)
+	}
+	if r.Min.Y > 0 {
+		if C.try_skip_scanlines(cinfo, C.JDIMENSION(r.Min.Y)) == 0 {
+			return 0, jpegError(cinfo.err, PhaseDecompress)
+		}
+	}
+	return r.Min.X - int(xoff), nil
+}
+
+// DecodeRegion decodes only the part of JPEG image d within rectangle r and
+// returns it as an image.Image whose bounds are r.
+// r is in the coordinates of the decoded image i.e. after scaling requested
+// by o, and must be within its bounds.
+//
+// libjpeg-turbo skips decompressing scanlines above r and, as much as MCU
+// alignment allows, pixels to the left and right of r, so this is much faster
+// than decoding the whole image and taking a sub-image.
+func DecodeRegion(d []byte, r image.Rectangle, o *DecodeOptions) (image.Image, error) {
+	dec, err := NewDecoder()
+	if err != nil {
+		return nil, err
+	}
+	defer dec.Close()
+	cinfo := dec.cinfo
+
+	var pinner runtime.Pinner
+	defer pinner.Unpin()
+	if err = memSrc(cinfo, d, &pinner); err != nil {
+		return nil, err
+	}
+	if err = readHeader(cinfo, o); err != nil {
+		return nil, err
+	}
+	if err = checkRegion(cinfo, r); err != nil {
+		return nil, err
+	}
+	f := PixelFormatDefault
+	if o != nil {
+		f = o.PixelFormat
+	}
+	nComp, err := startDecompress(cinfo, f)
+	if err != nil {
+		return nil, err
+	}
+	x0, err := startRegion(cinfo, r)
 	if err != nil {
 		return nil, err
 	}
-	return DecodeData(d)
+	// we don't read remaining scanlines so we can't jpeg_finish_decompress();
+	// jpeg_destroy_decompress() takes care of aborting decompression
+	return readScanlines(cinfo, nComp, f, r, x0, &dec.buf)
 }
@@ -2,16 +2,23 @@ package golibjpegturbo
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"image"
+	"image/color"
+	"image/color/palette"
 	"image/draw"
 	"image/jpeg"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"os/exec"
+	"reflect"
 	"testing"
+	"testing/iotest"
 )
 
 const (
@@ -218,6 +225,1705 @@ func TestReencode(t *testing.T) {
 	}
 }
 
+func pixEqual(img1, img2 image.Image) bool {
+	switch v1 := img1.(type) {
+	case *image.RGBA:
+		v2, ok := img2.(*image.RGBA)
+		return ok && v1.Rect == v2.Rect && bytes.Equal(v1.Pix, v2.Pix)
+	case *image.Gray:
+		v2, ok := img2.(*image.Gray)
+		return ok && v1.Rect == v2.Rect && bytes.Equal(v1.Pix, v2.Pix)
+	}
+	return false
+}
+
+func TestDecodeReader(t *testing.T) {
+	img1, err := DecodeData(imgData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// one byte at a time exercises refilling of source manager's buffer
+	img2, err := Decode(iotest.OneByteReader(bytes.NewReader(imgData)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pixEqual(img1, img2) {
+		t.Fatal("Decode() and DecodeData() results differ")
+	}
+}
+
+func TestDecodeReaderError(t *testing.T) {
+	r := iotest.TimeoutReader(iotest.HalfReader(bytes.NewReader(imgData)))
+	_, err := Decode(r)
+	if err != iotest.ErrTimeout {
+		t.Fatalf("expected %v, got %v", iotest.ErrTimeout, err)
+	}
+
+	// error returned with the last data, after which libjpeg needs no more
+	r = iotest.DataErrReader(&errReader{bytes.NewReader(imgData), errors.New("boom")})
+	if _, err = Decode(r); err == nil || err.Error() != "boom" {
+		t.Fatalf("expected boom error, got %v", err)
+	}
+
+	if _, err = Decode(bytes.NewReader(nil)); !errors.Is(err, ErrNotJPEG) {
+		t.Fatalf("expected ErrNotJPEG for empty reader, got %v", err)
+	}
+	if _, err = Decode(stuckReader{}); err != io.ErrNoProgress {
+		t.Fatalf("expected %v, got %v", io.ErrNoProgress, err)
+	}
+}
+
+// errReader returns err instead of io.EOF at the end of r
+type errReader struct {
+	r   io.Reader
+	err error
+}
+
+func (r *errReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err == io.EOF {
+		err = r.err
+	}
+	return n, err
+}
+
+// stuckReader never returns any data or error
+type stuckReader struct{}
+
+func (stuckReader) Read(p []byte) (int, error) {
+	return 0, nil
+}
+
+func TestDecodeReaderTruncated(t *testing.T) {
+	r := io.LimitReader(bytes.NewReader(imgData), int64(len(imgData)/2))
+	img, err := Decode(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds() != decodedImg.Bounds() {
+		t.Fatalf("unexpected bounds %v", img.Bounds())
+	}
+}
+
+func TestDecodeWarnings(t *testing.T) {
+	res, err := DecodeDataWithResult(imgData, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dy := decodedImg.Bounds().Dy()
+	if res.NumWarnings != 0 || res.Truncated || res.ValidScanlines != dy {
+		t.Fatalf("unexpected result for valid image: %+v", res)
+	}
+
+	truncated := imgData[:len(imgData)/2]
+	res, err = DecodeDataWithResult(truncated, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Truncated || res.NumWarnings == 0 || len(res.Warnings) == 0 {
+		t.Fatalf("expected truncated image with warnings: %+v", res)
+	}
+	if res.ValidScanlines <= 0 || res.ValidScanlines >= dy {
+		t.Fatalf("unexpected number of valid scanlines %d", res.ValidScanlines)
+	}
+	n := res.ValidScanlines * decodedImg.(*image.RGBA).Stride
+	if !bytes.Equal(res.Image.(*image.RGBA).Pix[:n], decodedImg.(*image.RGBA).Pix[:n]) {
+		t.Fatal("valid scanlines differ from the full image")
+	}
+
+	_, err = DecodeDataWithOptions(truncated, &DecodeOptions{Strict: true})
+	var jerr *Error
+	if !errors.Is(err, ErrTruncated) || !errors.As(err, &jerr) || jerr.Phase != PhaseDecompress {
+		t.Fatalf("expected ErrTruncated in strict mode, got %v", err)
+	}
+	if _, err = DecodeDataWithOptions(imgData, &DecodeOptions{Strict: true}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDecodeLimits(t *testing.T) {
+	b := decodedImg.Bounds()
+	ok := []*DecodeOptions{
+		{MaxWidth: b.Dx(), MaxHeight: b.Dy(), MaxPixels: b.Dx() * b.Dy()},
+		{MaxMemory: 64 << 20, MaxScans: 100},
+	}
+	for i, o := range ok {
+		if _, err := DecodeDataWithOptions(imgData, o); err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+	}
+	exceeded := []*DecodeOptions{
+		{MaxWidth: b.Dx() - 1},
+		{MaxHeight: b.Dy() - 1},
+		{MaxPixels: b.Dx()*b.Dy() - 1},
+	}
+	for i, o := range exceeded {
+		if _, err := DecodeDataWithOptions(imgData, o); !errors.Is(err, ErrLimitExceeded) {
+			t.Fatalf("%d: expected ErrLimitExceeded, got %v", i, err)
+		}
+		if _, err := GetJpegInfoWithOptions(imgData, o); !errors.Is(err, ErrLimitExceeded) {
+			t.Fatalf("%d: expected ErrLimitExceeded, got %v", i, err)
+		}
+	}
+
+	// progressive images are buffered whole before decoding
+	progressive := encodeWithOptions(t, decodedImg, &Options{Progressive: true})
+	exceeded = []*DecodeOptions{
+		{MaxMemory: 1 << 20},
+		{MaxScans: 3},
+	}
+	for i, o := range exceeded {
+		if _, err := DecodeDataWithOptions(progressive, o); !errors.Is(err, ErrLimitExceeded) {
+			t.Fatalf("%d: expected ErrLimitExceeded, got %v", i, err)
+		}
+	}
+	if _, err := DecodeDataWithOptions(imgData, &DecodeOptions{MaxScans: -1}); err == nil {
+		t.Fatal("expected error for invalid limit")
+	}
+}
+
+func TestDecodeContext(t *testing.T) {
+	var calls []Progress
+	o := &DecodeOptions{Progress: func(p Progress) { calls = append(calls, p) }}
+	img, err := DecodeContext(context.Background(), imgData, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pixEqual(img, decodedImg) {
+		t.Fatal("image decoded with progress monitor differs")
+	}
+	if len(calls) == 0 {
+		t.Fatal("progress wasn't reported")
+	}
+	for _, p := range calls {
+		if p.Total <= 0 || p.Completed > p.Total || p.Pass >= p.TotalPasses {
+			t.Fatalf("unexpected progress %+v", p)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	n := 0
+	o.Progress = func(p Progress) {
+		n++
+		if n == 10 {
+			cancel()
+		}
+	}
+	if _, err = DecodeContext(ctx, imgData, o); err != context.Canceled {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+	if n != 10 {
+		t.Fatalf("decoding wasn't aborted right away, %d calls", n)
+	}
+	// already canceled
+	if _, err = DecodeContext(ctx, imgData, nil); err != context.Canceled {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestEncodeContext(t *testing.T) {
+	passes := 0
+	o := &Options{Progressive: true, Progress: func(p Progress) {
+		if p.TotalPasses > passes {
+			passes = p.TotalPasses
+		}
+	}}
+	if err := EncodeContext(context.Background(), ioutil.Discard, decodedImg, o); err != nil {
+		t.Fatal(err)
+	}
+	// progressive encoding needs more than one pass
+	if passes < 2 {
+		t.Fatalf("unexpected number of passes %d", passes)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	o.Progress = func(p Progress) {
+		if p.Completed > 100 {
+			cancel()
+		}
+	}
+	if err := EncodeContext(ctx, ioutil.Discard, decodedImg, o); err != context.Canceled {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestDecodeConfig(t *testing.T) {
+	cfg, err := DecodeConfig(bytes.NewReader(imgData))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := decodedImg.Bounds()
+	if cfg.Width != b.Dx() || cfg.Height != b.Dy() {
+		t.Fatalf("unexpected size %dx%d, expected %dx%d", cfg.Width, cfg.Height, b.Dx(), b.Dy())
+	}
+	if cfg.ColorModel != decodedImg.ColorModel() {
+		t.Fatalf("unexpected color model")
+	}
+	info, err := GetJpegInfo(imgData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Width != cfg.Width || info.Height != cfg.Height {
+		t.Fatalf("GetJpegInfo() size %dx%d, expected %dx%d", info.Width, info.Height, cfg.Width, cfg.Height)
+	}
+}
+
+func TestDecodeScaled(t *testing.T) {
+	b := decodedImg.Bounds()
+	dx, dy := b.Dx(), b.Dy()
+	for m := 1; m <= 16; m++ {
+		o := &DecodeOptions{ScaleNum: m, ScaleDenom: 8}
+		img, err := DecodeDataWithOptions(imgData, o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// libjpeg rounds scaled dimensions up
+		expDx := (dx*m + 7) / 8
+		expDy := (dy*m + 7) / 8
+		if img.Bounds() != image.Rect(0, 0, expDx, expDy) {
+			t.Fatalf("scale %d/8: unexpected bounds %v", m, img.Bounds())
+		}
+		info, err := GetJpegInfoWithOptions(imgData, o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Width != expDx || info.Height != expDy || info.ImageWidth != dx || info.ImageHeight != dy {
+			t.Fatalf("scale %d/8: unexpected info %#v", m, info)
+		}
+	}
+}
+
+func TestDecodeMinSize(t *testing.T) {
+	b := decodedImg.Bounds()
+	dx := b.Dx()
+	o := &DecodeOptions{MinWidth: (dx*2+7)/8 + 1, MinHeight: 10}
+	img, err := DecodeDataWithOptions(imgData, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 2/8 would be too small, 3/8 is the smallest big enough
+	if img.Bounds().Dx() != (dx*3+7)/8 {
+		t.Fatalf("unexpected bounds %v", img.Bounds())
+	}
+	// images are not scaled up
+	o = &DecodeOptions{MinWidth: dx * 2}
+	img, err = DecodeDataWithOptions(imgData, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds() != b {
+		t.Fatalf("unexpected bounds %v", img.Bounds())
+	}
+	_, err = DecodeDataWithOptions(imgData, &DecodeOptions{ScaleNum: -1, ScaleDenom: 8})
+	if err == nil {
+		t.Fatal("expected error for invalid scale")
+	}
+}
+
+// maxPixDiff returns maximum difference between pixel components of img1 and
+// img2, which must have the same type and bounds
+func maxPixDiff(img1, img2 *image.RGBA) int {
+	maxDiff := 0
+	b := img1.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			off1 := img1.PixOffset(x, y)
+			off2 := img2.PixOffset(x, y)
+			for i := 0; i < 4; i++ {
+				d := int(img1.Pix[off1+i]) - int(img2.Pix[off2+i])
+				if d < 0 {
+					d = -d
+				}
+				if d > maxDiff {
+					maxDiff = d
+				}
+			}
+		}
+	}
+	return maxDiff
+}
+
+func TestDecodeRegion(t *testing.T) {
+	full := decodedImg.(*image.RGBA)
+	b := full.Bounds()
+	regions := []image.Rectangle{
+		b,
+		image.Rect(0, 0, 1, 1),
+		image.Rect(13, 27, 200, 301),
+		image.Rect(b.Dx()/2, b.Dy()/2, b.Dx(), b.Dy()),
+		image.Rect(b.Dx()-1, b.Dy()-1, b.Dx(), b.Dy()),
+	}
+	for _, r := range regions {
+		img, err := DecodeRegion(imgData, r, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if img.Bounds() != r {
+			t.Fatalf("unexpected bounds %v, expected %v", img.Bounds(), r)
+		}
+		sub := full.SubImage(r).(*image.RGBA)
+		if d := maxPixDiff(img.(*image.RGBA), sub); d != 0 {
+			t.Fatalf("region %v differs from sub-image by %d", r, d)
+		}
+	}
+	_, err := DecodeRegion(imgData, image.Rect(0, 0, b.Dx()+1, 10), nil)
+	if err == nil {
+		t.Fatal("expected error for region outside of image")
+	}
+	// region is in scaled coordinates
+	o := &DecodeOptions{ScaleNum: 1, ScaleDenom: 2}
+	r := image.Rect(10, 10, 50, 60)
+	img, err := DecodeRegion(imgData, r, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds() != r {
+		t.Fatalf("unexpected bounds %v, expected %v", img.Bounds(), r)
+	}
+}
+
+func TestDecodeInto(t *testing.T) {
+	full := decodedImg.(*image.RGBA)
+	b := full.Bounds()
+	at := image.Pt(7, 5)
+	r := b.Add(at)
+	bg := color.RGBA{10, 20, 30, 255}
+	dstBounds := image.Rect(-3, 0, b.Dx()+20, b.Dy()+10)
+	dsts := []draw.Image{
+		image.NewRGBA(dstBounds),
+		image.NewNRGBA(dstBounds),
+		image.NewRGBA64(dstBounds),
+	}
+	for _, dst := range dsts {
+		draw.Draw(dst, dst.Bounds(), image.NewUniform(bg), image.Point{}, draw.Src)
+		res, err := DecodeInto(dst, at, imgData, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res != r {
+			t.Fatalf("%T: unexpected rectangle %v, expected %v", dst, res, r)
+		}
+		for y := dstBounds.Min.Y; y < dstBounds.Max.Y; y++ {
+			for x := dstBounds.Min.X; x < dstBounds.Max.X; x++ {
+				var expected color.Color = bg
+				if image.Pt(x, y).In(r) {
+					expected = full.At(x-at.X, y-at.Y)
+				}
+				if !colorEqual(dst.At(x, y), expected) {
+					t.Fatalf("%T: unexpected color %v at %d,%d, expected %v", dst, dst.At(x, y), x, y, expected)
+				}
+			}
+		}
+	}
+
+	// color image decoded into grayscale
+	gray := image.NewGray(dstBounds)
+	if _, err := DecodeInto(gray, at, imgData, nil); err != nil {
+		t.Fatal(err)
+	}
+	// it's the luma of the image, which image/jpeg gives us
+	img, err := jpeg.Decode(bytes.NewReader(imgData))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := img.(*image.YCbCr)
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			d := int(gray.GrayAt(x+at.X, y+at.Y).Y) - int(expected.Y[expected.YOffset(x, y)])
+			if d < -2 || d > 2 {
+				t.Fatalf("gray pixel at %d,%d differs by %d", x, y, d)
+			}
+		}
+	}
+
+	// scaled image fits where the full size one doesn't
+	small := image.NewRGBA(image.Rect(0, 0, (b.Dx()+1)/2, (b.Dy()+1)/2))
+	if _, err := DecodeInto(small, image.Point{}, imgData, nil); !errors.Is(err, ErrInvalidDimensions) {
+		t.Fatalf("expected ErrInvalidDimensions, got %v", err)
+	}
+	o := &DecodeOptions{ScaleNum: 1, ScaleDenom: 2}
+	res, err := DecodeInto(small, image.Point{}, imgData, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != small.Bounds() {
+		t.Fatalf("unexpected rectangle %v", res)
+	}
+}
+
+func colorEqual(c1, c2 color.Color) bool {
+	r1, g1, b1, a1 := c1.RGBA()
+	r2, g2, b2, a2 := c2.RGBA()
+	return r1 == r2 && g1 == g2 && b1 == b2 && a1 == a2
+}
+
+func TestDecodeYCbCr(t *testing.T) {
+	// odd size, so that chroma planes are rounded up
+	src := decodedImg.(*image.RGBA).SubImage(image.Rect(3, 5, 104, 72))
+	ratios := map[Subsampling]image.YCbCrSubsampleRatio{
+		Subsampling444: image.YCbCrSubsampleRatio444,
+		Subsampling422: image.YCbCrSubsampleRatio422,
+		Subsampling420: image.YCbCrSubsampleRatio420,
+		Subsampling440: image.YCbCrSubsampleRatio440,
+		Subsampling411: image.YCbCrSubsampleRatio411,
+	}
+	for s, ratio := range ratios {
+		var buf bytes.Buffer
+		if err := Encode(&buf, src, &Options{Quality: 90, Subsampling: s}); err != nil {
+			t.Fatal(err)
+		}
+		img, err := DecodeDataWithOptions(buf.Bytes(), &DecodeOptions{YCbCr: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, ok := img.(*image.YCbCr)
+		if !ok {
+			t.Fatalf("%v: expected *image.YCbCr, got %T", ratio, img)
+		}
+		if m.SubsampleRatio != ratio || m.Bounds() != image.Rect(0, 0, 101, 67) {
+			t.Fatalf("unexpected ratio %v or bounds %v, expected %v", m.SubsampleRatio, m.Bounds(), ratio)
+		}
+		// image/jpeg also decodes to YCbCr without upsampling
+		goImg, err := jpeg.Decode(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := goImg.(*image.YCbCr)
+		for y := 0; y < 67; y++ {
+			for x := 0; x < 101; x++ {
+				yi, ci := m.YOffset(x, y), m.COffset(x, y)
+				eyi, eci := expected.YOffset(x, y), expected.COffset(x, y)
+				for _, d := range []int{
+					int(m.Y[yi]) - int(expected.Y[eyi]),
+					int(m.Cb[ci]) - int(expected.Cb[eci]),
+					int(m.Cr[ci]) - int(expected.Cr[eci]),
+				} {
+					if d < -2 || d > 2 {
+						t.Fatalf("%v: pixel at %d,%d differs by %d", ratio, x, y, d)
+					}
+				}
+			}
+		}
+
+		img, err = DecodeDataWithOptions(buf.Bytes(), &DecodeOptions{YCbCr: true, ScaleNum: 1, ScaleDenom: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := img.(*image.YCbCr); !ok || img.Bounds() != image.Rect(0, 0, 51, 34) {
+			t.Fatalf("%v: unexpected scaled image %T %v", ratio, img, img.Bounds())
+		}
+	}
+
+	// images that aren't YCbCr are decoded as usual
+	var buf bytes.Buffer
+	if err := Encode(&buf, src, &Options{Quality: 90, ColorSpace: ColorSpaceRGB}); err != nil {
+		t.Fatal(err)
+	}
+	img, err := DecodeDataWithOptions(buf.Bytes(), &DecodeOptions{YCbCr: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := img.(*image.RGBA); !ok {
+		t.Fatalf("expected *image.RGBA, got %T", img)
+	}
+	buf.Reset()
+	if err := Encode(&buf, image.NewGray(image.Rect(0, 0, 9, 9)), nil); err != nil {
+		t.Fatal(err)
+	}
+	img, err = DecodeDataWithOptions(buf.Bytes(), &DecodeOptions{YCbCr: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := img.(*image.Gray); !ok {
+		t.Fatalf("expected *image.Gray, got %T", img)
+	}
+}
+
+func TestEncodeYCbCr(t *testing.T) {
+	img, err := DecodeDataWithOptions(imgData, &DecodeOptions{YCbCr: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := img.(*image.YCbCr)
+	r := image.Rect(4, 6, 105, 73)
+	crops := []*image.YCbCr{
+		src,
+		src.SubImage(r).(*image.YCbCr),
+	}
+	// other subsample ratios, filled with a gradient
+	for _, ratio := range []image.YCbCrSubsampleRatio{image.YCbCrSubsampleRatio440, image.YCbCrSubsampleRatio410} {
+		m := image.NewYCbCr(image.Rect(0, 0, 45, 31), ratio)
+		for y := 0; y < 31; y++ {
+			for x := 0; x < 45; x++ {
+				m.Y[m.YOffset(x, y)] = uint8(x * 5)
+				m.Cb[m.COffset(x, y)] = uint8(y * 8)
+				m.Cr[m.COffset(x, y)] = uint8(255 - x*5)
+			}
+		}
+		crops = append(crops, m)
+	}
+	for _, m := range crops {
+		var buf bytes.Buffer
+		if err := Encode(&buf, m, &Options{Quality: 100, Subsampling: Subsampling444}); err != nil {
+			t.Fatal(err)
+		}
+		img, err := DecodeDataWithOptions(buf.Bytes(), &DecodeOptions{YCbCr: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := img.(*image.YCbCr)
+		// subsampling of the image is kept and there's no color conversion loss
+		b := m.Bounds()
+		if res.SubsampleRatio != m.SubsampleRatio || res.Bounds() != image.Rect(0, 0, b.Dx(), b.Dy()) {
+			t.Fatalf("unexpected ratio %v or bounds %v", res.SubsampleRatio, res.Bounds())
+		}
+		for y := 0; y < b.Dy(); y++ {
+			for x := 0; x < b.Dx(); x++ {
+				yi, ci := res.YOffset(x, y), res.COffset(x, y)
+				eyi, eci := m.YOffset(b.Min.X+x, b.Min.Y+y), m.COffset(b.Min.X+x, b.Min.Y+y)
+				for _, d := range []int{
+					int(res.Y[yi]) - int(m.Y[eyi]),
+					int(res.Cb[ci]) - int(m.Cb[eci]),
+					int(res.Cr[ci]) - int(m.Cr[eci]),
+				} {
+					if d < -2 || d > 2 {
+						t.Fatalf("%v: pixel at %d,%d differs by %d", m.SubsampleRatio, x, y, d)
+					}
+				}
+			}
+		}
+	}
+
+	// sub-image that doesn't start at a chroma sample is encoded with
+	// Subsampling, like other images
+	var buf bytes.Buffer
+	if err := Encode(&buf, src.SubImage(r.Add(image.Pt(1, 1))), &Options{Subsampling: Subsampling444}); err != nil {
+		t.Fatal(err)
+	}
+	img, err = DecodeDataWithOptions(buf.Bytes(), &DecodeOptions{YCbCr: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := img.(*image.YCbCr); m.SubsampleRatio != image.YCbCrSubsampleRatio444 || m.Bounds() != image.Rect(0, 0, r.Dx(), r.Dy()) {
+		t.Fatalf("unexpected ratio %v or bounds %v", m.SubsampleRatio, m.Bounds())
+	}
+}
+
+func TestYUV(t *testing.T) {
+	// odd size source image, with padded planes
+	var buf bytes.Buffer
+	if err := Encode(&buf, decodedImg.(*image.RGBA).SubImage(image.Rect(0, 0, 101, 67)), &Options{Quality: 95}); err != nil {
+		t.Fatal(err)
+	}
+	jpg := append([]byte(nil), buf.Bytes()...)
+	img, err := DecodeDataWithOptions(jpg, &DecodeOptions{YCbCr: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := img.(*image.YCbCr)
+	for _, format := range []YUVFormat{I420, NV12, YUYV} {
+		planes, width, height, err := DecodeToYUV(jpg, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if width != 101 || height != 67 {
+			t.Fatalf("%v: unexpected size %dx%d", format, width, height)
+		}
+		frame := &yuvImage{planes: planes, format: format, width: width, height: height}
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				c := frame.At(x, y).(color.YCbCr)
+				e := src.YCbCrAt(x, y)
+				if format != YUYV && c != e {
+					t.Fatalf("%v: unexpected color %v at %d,%d, expected %v", format, c, x, y, e)
+				}
+				// vertically averaged chroma
+				if format == YUYV && c.Y != e.Y {
+					t.Fatalf("%v: unexpected luma %d at %d,%d, expected %d", format, c.Y, x, y, e.Y)
+				}
+			}
+		}
+
+		// pad the planes
+		padded := make([]YUVPlane, len(planes))
+		for i, p := range planes {
+			stride := p.Stride + 13
+			rows := len(p.Data) / p.Stride
+			data := make([]byte, stride*(rows-1)+p.Stride)
+			for y := 0; y < rows; y++ {
+				copy(data[y*stride:], p.Data[y*p.Stride:(y+1)*p.Stride])
+			}
+			padded[i] = YUVPlane{Data: data, Stride: stride}
+		}
+		buf.Reset()
+		if err := EncodeYUV(&buf, padded, format, width, height, &Options{Quality: 100}); err != nil {
+			t.Fatal(err)
+		}
+		img, err := DecodeDataWithOptions(buf.Bytes(), &DecodeOptions{YCbCr: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := img.(*image.YCbCr)
+		ratio := image.YCbCrSubsampleRatio420
+		if format == YUYV {
+			ratio = image.YCbCrSubsampleRatio422
+		}
+		if m.SubsampleRatio != ratio || m.Bounds() != image.Rect(0, 0, width, height) {
+			t.Fatalf("%v: unexpected ratio %v or bounds %v", format, m.SubsampleRatio, m.Bounds())
+		}
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				c, e := m.YCbCrAt(x, y), frame.At(x, y).(color.YCbCr)
+				for _, d := range []int{int(c.Y) - int(e.Y), int(c.Cb) - int(e.Cb), int(c.Cr) - int(e.Cr)} {
+					if d < -2 || d > 2 {
+						t.Fatalf("%v: pixel at %d,%d differs by %d", format, x, y, d)
+					}
+				}
+			}
+		}
+
+		stride := padded[0].Stride
+		padded[0].Stride = planes[0].Stride - 1
+		if err := EncodeYUV(&buf, padded, format, width, height, nil); err == nil {
+			t.Fatalf("%v: expected error for too small stride", format)
+		}
+		padded[0].Stride = stride
+		padded[0].Data = padded[0].Data[:len(padded[0].Data)-1]
+		if err := EncodeYUV(&buf, padded, format, width, height, nil); err == nil {
+			t.Fatalf("%v: expected error for too small plane", format)
+		}
+	}
+
+	// grayscale has neutral chroma
+	buf.Reset()
+	if err := Encode(&buf, image.NewGray(image.Rect(0, 0, 9, 9)), nil); err != nil {
+		t.Fatal(err)
+	}
+	planes, _, _, err := DecodeToYUV(buf.Bytes(), NV12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range planes[1].Data {
+		if v != 128 {
+			t.Fatalf("unexpected chroma %d", v)
+		}
+	}
+	if _, _, _, err := DecodeToYUV(jpg, YUYV+1); err == nil {
+		t.Fatal("expected error for invalid format")
+	}
+}
+
+func TestPixelFormat(t *testing.T) {
+	full := decodedImg.(*image.RGBA)
+	b := full.Bounds()
+	region := image.Rect(33, 41, 250, 199)
+	for f := PixelFormatRGBA; f <= PixelFormatABGR; f++ {
+		if f == PixelFormatGray {
+			continue
+		}
+		img, err := DecodeDataWithOptions(imgData, &DecodeOptions{PixelFormat: f})
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch f {
+		case PixelFormatRGBA:
+			_, ok := img.(*image.RGBA)
+			if !ok {
+				t.Fatalf("%v: unexpected image type %T", f, img)
+			}
+		case PixelFormatNRGBA:
+			_, ok := img.(*image.NRGBA)
+			if !ok {
+				t.Fatalf("%v: unexpected image type %T", f, img)
+			}
+		default:
+			raw, ok := img.(*RawImage)
+			if !ok || raw.Format != f || raw.Stride != b.Dx()*f.BytesPerPixel() {
+				t.Fatalf("%v: unexpected image %T", f, img)
+			}
+		}
+		if img.Bounds() != b {
+			t.Fatalf("%v: unexpected bounds %v", f, img.Bounds())
+		}
+		for y := 0; y < b.Dy(); y++ {
+			for x := 0; x < b.Dx(); x++ {
+				if !colorEqual(img.At(x, y), full.At(x, y)) {
+					t.Fatalf("%v: unexpected color %v at %d,%d, expected %v", f, img.At(x, y), x, y, full.At(x, y))
+				}
+			}
+		}
+
+		sub, err := DecodeRegion(imgData, region, &DecodeOptions{PixelFormat: f})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sub.Bounds() != region {
+			t.Fatalf("%v: unexpected region bounds %v", f, sub.Bounds())
+		}
+		for y := region.Min.Y; y < region.Max.Y; y++ {
+			for x := region.Min.X; x < region.Max.X; x++ {
+				if !colorEqual(sub.At(x, y), full.At(x, y)) {
+					t.Fatalf("%v: unexpected region color %v at %d,%d, expected %v", f, sub.At(x, y), x, y, full.At(x, y))
+				}
+			}
+		}
+	}
+
+	// color image decoded as grayscale is its luma
+	img, err := DecodeDataWithOptions(imgData, &DecodeOptions{PixelFormat: PixelFormatGray})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gray, ok := img.(*image.Gray)
+	if !ok {
+		t.Fatalf("unexpected image type %T", img)
+	}
+	goImg, err := jpeg.Decode(bytes.NewReader(imgData))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := goImg.(*image.YCbCr)
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			d := int(gray.GrayAt(x, y).Y) - int(expected.Y[expected.YOffset(x, y)])
+			if d < -2 || d > 2 {
+				t.Fatalf("gray pixel at %d,%d differs by %d", x, y, d)
+			}
+		}
+	}
+
+	// grayscale image decoded as color
+	var buf bytes.Buffer
+	if err := Encode(&buf, gray, nil); err != nil {
+		t.Fatal(err)
+	}
+	img, err = DecodeDataWithOptions(buf.Bytes(), &DecodeOptions{PixelFormat: PixelFormatBGRA})
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := img.(*RawImage)
+	for i := 0; i < len(raw.Pix); i += 4 {
+		p := raw.Pix[i : i+4]
+		if p[0] != p[1] || p[1] != p[2] || p[3] != 0xff {
+			t.Fatalf("unexpected pixel %v", p)
+		}
+	}
+
+	// CMYK images are converted from RGBA
+	rgba := image.NewRGBA(image.Rect(0, 0, 2, 1))
+	copy(rgba.Pix, []byte{10, 20, 30, 255, 200, 100, 50, 255})
+	if raw := convertRGBA(rgba, PixelFormatXBGR).(*RawImage); !bytes.Equal(raw.Pix, []byte{255, 30, 20, 10, 255, 50, 100, 200}) {
+		t.Fatalf("unexpected pixels %v", raw.Pix)
+	}
+	if g := convertRGBA(rgba, PixelFormatGray).(*image.Gray); g.Pix[0] != color.GrayModel.Convert(rgba.At(0, 0)).(color.Gray).Y {
+		t.Fatalf("unexpected gray pixel %d", g.Pix[0])
+	}
+
+	if _, err := DecodeDataWithOptions(imgData, &DecodeOptions{PixelFormat: PixelFormatCMYK + 1}); err == nil {
+		t.Fatal("expected error for invalid pixel format")
+	}
+	if n := PixelFormat(99).BytesPerPixel(); n != 0 {
+		t.Fatalf("unexpected size %d of invalid pixel format", n)
+	}
+}
+
+func TestDecodeTensor(t *testing.T) {
+	// checks that t has pixels of img, normalized with mean and std
+	check := func(tn *Tensor, img image.Image, mean, std []float32) {
+		t.Helper()
+		b := img.Bounds()
+		if tn.Width != b.Dx() || tn.Height != b.Dy() || len(tn.Data) != b.Dx()*b.Dy()*tn.Channels {
+			t.Fatalf("unexpected tensor size %v, expected %v", tn.Shape(), b)
+		}
+		for y := 0; y < b.Dy(); y++ {
+			for x := 0; x < b.Dx(); x++ {
+				var v [3]uint8
+				if tn.Channels == 1 {
+					v[0] = img.(*image.Gray).GrayAt(b.Min.X+x, b.Min.Y+y).Y
+				} else {
+					c := img.At(b.Min.X+x, b.Min.Y+y).(color.RGBA)
+					v = [3]uint8{c.R, c.G, c.B}
+				}
+				for c := 0; c < tn.Channels; c++ {
+					i := (y*tn.Width+x)*tn.Channels + c
+					if tn.Layout == LayoutCHW {
+						i = (c*tn.Height+y)*tn.Width + x
+					}
+					expected := (float32(v[c])/255 - mean[c]) / std[c]
+					if d := tn.Data[i] - expected; d < -1e-5 || d > 1e-5 {
+						t.Fatalf("value of channel %d at %d,%d is %f, expected %f", c, x, y, tn.Data[i], expected)
+					}
+				}
+			}
+		}
+	}
+
+	zero, one := []float32{0, 0, 0}, []float32{1, 1, 1}
+	tn, err := DecodeTensor(imgData, LayoutHWC, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := decodedImg.Bounds()
+	if s := tn.Shape(); s[0] != b.Dy() || s[1] != b.Dx() || s[2] != 3 {
+		t.Fatalf("unexpected shape %v", s)
+	}
+	check(tn, decodedImg, zero, one)
+
+	mean := []float32{0.485, 0.456, 0.406}
+	std := []float32{0.229, 0.224, 0.225}
+	do := &DecodeOptions{ScaleNum: 1, ScaleDenom: 4}
+	tn, err = DecodeTensor(imgData, LayoutCHW, mean, std, &TensorOptions{Decode: do})
+	if err != nil {
+		t.Fatal(err)
+	}
+	scaled, err := DecodeDataWithOptions(imgData, do)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(tn, scaled, mean, std)
+
+	region := image.Rect(33, 41, 250, 199)
+	tn, err = DecodeTensor(imgData, LayoutCHW, mean, std, &TensorOptions{Region: region})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(tn, decodedImg.(*image.RGBA).SubImage(region), mean, std)
+
+	gray, err := DecodeDataWithOptions(imgData, &DecodeOptions{PixelFormat: PixelFormatGray})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tn, err = DecodeTensor(imgData, LayoutHWC, []float32{0.5}, []float32{0.5}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(tn, gray, []float32{0.5}, []float32{0.5})
+
+	// CMYK
+	dst := make([]float32, 6)
+	lut := [][256]float32{{}, {}, {}}
+	for c := range lut {
+		for v := range lut[c] {
+			lut[c][v] = float32(v)
+		}
+	}
+	cmykToTensor(dst, []byte{255, 100, 0, 255, 10, 20, 30, 0}, true, lut, 1, 2)
+	if !reflect.DeepEqual(dst, []float32{255, 0, 100, 0, 0, 0}) {
+		t.Fatalf("unexpected values %v", dst)
+	}
+
+	if _, err := DecodeTensor(imgData, LayoutHWC, []float32{0, 0}, []float32{1, 1}, nil); err == nil {
+		t.Fatal("expected error for 2 channels")
+	}
+	if _, err := DecodeTensor(imgData, LayoutHWC, zero, []float32{1, 0, 1}, nil); err == nil {
+		t.Fatal("expected error for std of 0")
+	}
+	if _, err := DecodeTensor(imgData, LayoutCHW+1, nil, nil, nil); err == nil {
+		t.Fatal("expected error for invalid layout")
+	}
+}
+
+// flatJPEG returns baseline 4 component JPEG data with samples of m,
+// which are stored as they are. Every 8x8 block is flat with the color of
+// its top-left pixel, so libjpeg and image/jpeg decode it exactly. If
+// transform isn't negative, Adobe APP14 marker with that transform is
+// written.
+func flatJPEG(m *image.CMYK, transform int) []byte {
+	b := m.Bounds()
+	var d []byte
+	segment := func(marker byte, data ...byte) {
+		n := len(data) + 2
+		d = append(d, 0xff, marker, byte(n>>8), byte(n))
+		d = append(d, data...)
+	}
+	d = append(d, 0xff, 0xd8)
+	if transform >= 0 {
+		segment(0xee, 'A', 'd', 'o', 'b', 'e', 0, 100, 0, 0, 0, 0, byte(transform))
+	}
+	// all quantization values are 1
+	segment(0xdb, append([]byte{0}, bytes.Repeat([]byte{1}, 64)...)...)
+	segment(0xc0, 8, byte(b.Dy()>>8), byte(b.Dy()), byte(b.Dx()>>8), byte(b.Dx()), 4,
+		1, 0x11, 0, 2, 0x11, 0, 3, 0x11, 0, 4, 0x11, 0)
+	// DC table has 4 bit codes for all categories, AC table only has EOB
+	segment(0xc4, 0x00, 0, 0, 0, 12, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11,
+		0x10, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0)
+	segment(0xda, 4, 1, 0, 2, 0, 3, 0, 4, 0, 0, 63, 0)
+
+	var acc uint32
+	var nBits uint
+	put := func(v uint32, n uint) {
+		acc = acc<<n | v&(1<<n-1)
+		nBits += n
+		for ; nBits >= 8; nBits -= 8 {
+			c := byte(acc >> (nBits - 8))
+			d = append(d, c)
+			if c == 0xff {
+				d = append(d, 0)
+			}
+		}
+	}
+	var pred [4]int
+	for by := b.Min.Y; by < b.Max.Y; by += 8 {
+		for bx := b.Min.X; bx < b.Max.X; bx += 8 {
+			p := m.Pix[m.PixOffset(bx, by):]
+			for ci := 0; ci < 4; ci++ {
+				// DC of a flat block is 8 times the level shifted sample
+				dc := (int(p[ci]) - 128) * 8
+				diff := dc - pred[ci]
+				pred[ci] = dc
+				cat := uint(0)
+				for a := max(diff, -diff); a > 0; a >>= 1 {
+					cat++
+				}
+				put(uint32(cat), 4)
+				if diff < 0 {
+					diff--
+				}
+				put(uint32(diff), cat)
+				put(0, 1)
+			}
+		}
+	}
+	put(0x7f, 7)
+	return append(d, 0xff, 0xd9)
+}
+
+func TestCMYK(t *testing.T) {
+	src := image.NewCMYK(image.Rect(0, 0, 64, 48))
+	for y := 0; y < 48; y++ {
+		for x := 0; x < 64; x++ {
+			bx, by := x/8*8, y/8*8
+			src.SetCMYK(x, y, color.CMYK{C: uint8(bx * 4), M: uint8(by * 5), Y: 100, K: uint8(bx + by)})
+		}
+	}
+	cmykDiff := func(c1, c2 color.CMYK) int {
+		d := 0
+		for _, v := range []int{int(c1.C) - int(c2.C), int(c1.M) - int(c2.M), int(c1.Y) - int(c2.Y), int(c1.K) - int(c2.K)} {
+			d = max(d, v, -v)
+		}
+		return d
+	}
+	// samples stored in files with Adobe marker: inverted CMYK, or YCbCr of
+	// RGB that libjpeg inverts to CMY and inverted K
+	inverted := image.NewCMYK(src.Rect)
+	ycck := image.NewCMYK(src.Rect)
+	for i := 0; i < len(src.Pix); i += 4 {
+		p := src.Pix[i : i+4]
+		inverted.Pix[i], inverted.Pix[i+1], inverted.Pix[i+2], inverted.Pix[i+3] = 255-p[0], 255-p[1], 255-p[2], 255-p[3]
+		ycck.Pix[i], ycck.Pix[i+1], ycck.Pix[i+2] = color.RGBToYCbCr(p[0], p[1], p[2])
+		ycck.Pix[i+3] = 255 - p[3]
+	}
+
+	for _, transform := range []int{0, 2} {
+		// YCbCr of CMY can't be exact
+		data, csName, tolerance := flatJPEG(inverted, 0), "cmyk", 0
+		if transform == 2 {
+			data, csName, tolerance = flatJPEG(ycck, 2), "ycck", 2
+		}
+		info, err := GetJpegInfo(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Components != 4 || info.ColorSpaceString != csName || !info.AdobeMarker || info.AdobeTransform != transform || !info.InvertedCMYK {
+			t.Fatalf("unexpected info %+v", info)
+		}
+
+		img, err := DecodeDataWithOptions(data, &DecodeOptions{PixelFormat: PixelFormatCMYK})
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := img.(*image.CMYK)
+		// image/jpeg also inverts Adobe CMYK
+		goImg, err := jpeg.Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := goImg.(*image.CMYK)
+		rgba, err := DecodeData(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for y := 0; y < 48; y++ {
+			for x := 0; x < 64; x++ {
+				if d := cmykDiff(m.CMYKAt(x, y), src.CMYKAt(x, y)); d > tolerance {
+					t.Fatalf("%v: pixel at %d,%d differs by %d", csName, x, y, d)
+				}
+				if d := cmykDiff(m.CMYKAt(x, y), expected.CMYKAt(x, y)); d > tolerance {
+					t.Fatalf("%v: pixel at %d,%d differs from image/jpeg by %d", csName, x, y, d)
+				}
+				c := m.CMYKAt(x, y)
+				r, g, b := cmykToRGB(c.C, c.M, c.Y, c.K, false)
+				if rgba.At(x, y) != (color.RGBA{r, g, b, 255}) {
+					t.Fatalf("%v: unexpected color %v at %d,%d", csName, rgba.At(x, y), x, y)
+				}
+			}
+		}
+	}
+
+	// without Adobe marker CMYK isn't inverted
+	data := flatJPEG(inverted, -1)
+	info, err := GetJpegInfo(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ColorSpaceString != "cmyk" || info.AdobeMarker || info.InvertedCMYK {
+		t.Fatalf("unexpected info %+v", info)
+	}
+	img, err := DecodeDataWithOptions(data, &DecodeOptions{PixelFormat: PixelFormatCMYK})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, e := img.(*image.CMYK).CMYKAt(10, 20), inverted.CMYKAt(10, 20); c != e {
+		t.Fatalf("unexpected color %v, expected %v", c, e)
+	}
+
+	// other images are converted
+	img, err = DecodeDataWithOptions(imgData, &DecodeOptions{PixelFormat: PixelFormatCMYK})
+	if err != nil {
+		t.Fatal(err)
+	}
+	full := decodedImg.(*image.RGBA)
+	if c, e := img.(*image.CMYK).CMYKAt(100, 100), color.CMYKModel.Convert(full.At(100, 100)); c != e {
+		t.Fatalf("unexpected color %v, expected %v", c, e)
+	}
+}
+
+func TestThumbnail(t *testing.T) {
+	b := decodedImg.Bounds()
+	for _, f := range []ResampleFilter{Lanczos3, CatmullRom} {
+		o := &ThumbnailOptions{Filter: f}
+		img, err := Thumbnail(imgData, 100, 100, o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expDx, expDy := thumbnailSize(b.Dx(), b.Dy(), 100, 100)
+		if img.Bounds() != image.Rect(0, 0, expDx, expDy) {
+			t.Fatalf("unexpected bounds %v", img.Bounds())
+		}
+		if expDx > 100 || expDy > 100 || (expDx != 100 && expDy != 100) {
+			t.Fatalf("unexpected thumbnail size %dx%d", expDx, expDy)
+		}
+	}
+	// not scaled up
+	img, err := Thumbnail(imgData, b.Dx()*2, b.Dy()*2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds() != b {
+		t.Fatalf("unexpected bounds %v", img.Bounds())
+	}
+
+	var buf bytes.Buffer
+	o := &ThumbnailOptions{Encode: &Options{Quality: 90}}
+	if err = EncodeThumbnail(&buf, imgData, 64, 64, o); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := DecodeConfig(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Width > 64 || cfg.Height != 64 {
+		t.Fatalf("unexpected size %dx%d", cfg.Width, cfg.Height)
+	}
+}
+
+func TestResampleUniform(t *testing.T) {
+	// resampling a uniform image must not change its color, which catches
+	// both incorrect normalization of weights and gamma conversion
+	src := image.NewRGBA(image.Rect(0, 0, 37, 53))
+	for i := range src.Pix {
+		src.Pix[i] = []uint8{200, 100, 30, 255}[i%4]
+	}
+	for _, f := range []ResampleFilter{Lanczos3, CatmullRom} {
+		dst := resample(src, 10, 7, f).(*image.RGBA)
+		for i, v := range dst.Pix {
+			if v != src.Pix[i%4] {
+				t.Fatalf("filter %d: pixel component %d is %d, expected %d", f, i, v, src.Pix[i%4])
+			}
+		}
+	}
+}
+
+// findMarker returns the offset of the first marker m in JPEG data d
+// (before the image data) or -1
+func findMarker(d []byte, m byte) int {
+	off := 2
+	for off+4 <= len(d) && d[off] == 0xff {
+		if d[off+1] == m {
+			return off
+		}
+		if d[off+1] == 0xda {
+			break
+		}
+		off += 2 + int(d[off+2])<<8 + int(d[off+3])
+	}
+	return -1
+}
+
+// sofInfo returns SOF marker and luma sampling factors of JPEG data d
+func sofInfo(t *testing.T, d []byte) (marker byte, h, v int) {
+	for _, m := range []byte{0xc0, 0xc1, 0xc2, 0xc9, 0xca} {
+		if off := findMarker(d, m); off >= 0 {
+			// length(2) precision(1) height(2) width(2) ncomp(1) id(1) hv(1)
+			hv := d[off+4+7]
+			return m, int(hv >> 4), int(hv & 0xf)
+		}
+	}
+	t.Fatal("no SOF marker")
+	return
+}
+
+func encodeWithOptions(t *testing.T, img image.Image, o *Options) []byte {
+	var buf bytes.Buffer
+	if err := Encode(&buf, img, o); err != nil {
+		t.Fatal(err)
+	}
+	img2, err := DecodeData(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img2.Bounds().Size() != img.Bounds().Size() {
+		t.Fatalf("unexpected size %v", img2.Bounds())
+	}
+	return buf.Bytes()
+}
+
+func TestEncodeOptions(t *testing.T) {
+	subsamplings := map[Subsampling][2]int{
+		Subsampling420: {2, 2},
+		Subsampling444: {1, 1},
+		Subsampling422: {2, 1},
+		Subsampling440: {1, 2},
+		Subsampling411: {4, 1},
+	}
+	for ss, f := range subsamplings {
+		d := encodeWithOptions(t, decodedImg, &Options{Quality: 90, Subsampling: ss})
+		m, h, v := sofInfo(t, d)
+		if m != 0xc0 || h != f[0] || v != f[1] {
+			t.Fatalf("subsampling %d: unexpected SOF %x %dx%d", ss, m, h, v)
+		}
+	}
+
+	d := encodeWithOptions(t, decodedImg, &Options{Progressive: true})
+	if m, _, _ := sofInfo(t, d); m != 0xc2 {
+		t.Fatalf("expected progressive SOF, got %x", m)
+	}
+	d = encodeWithOptions(t, decodedImg, &Options{Arithmetic: true})
+	if m, _, _ := sofInfo(t, d); m != 0xc9 {
+		t.Fatalf("expected arithmetic SOF, got %x", m)
+	}
+	d = encodeWithOptions(t, decodedImg, &Options{RestartInterval: 10})
+	if findMarker(d, 0xdd) < 0 {
+		t.Fatal("expected DRI marker")
+	}
+	d1 := encodeWithOptions(t, decodedImg, &Options{Quality: 90})
+	d2 := encodeWithOptions(t, decodedImg, &Options{Quality: 90, OptimizeHuffman: true})
+	if len(d2) >= len(d1) {
+		t.Fatalf("optimized Huffman tables didn't make the file smaller (%d vs %d)", len(d2), len(d1))
+	}
+	encodeWithOptions(t, decodedImg, &Options{DCTMethod: DCTFloat, Smoothing: 50})
+	// low quality is baseline unless 16 bit quantization values are allowed
+	for _, o := range []*Options{{Quality: 5}, {Quality: 5, AllowExtendedQuant: true}} {
+		d = encodeWithOptions(t, decodedImg, o)
+		maxQuant := 0
+		for _, tbl := range dqtTables(d) {
+			for _, v := range tbl {
+				maxQuant = max(maxQuant, v)
+			}
+		}
+		m, _, _ := sofInfo(t, d)
+		if o.AllowExtendedQuant && (m != 0xc1 || maxQuant <= 255) {
+			t.Fatalf("expected extended SOF and 16 bit quantization, got %x and %d", m, maxQuant)
+		}
+		if !o.AllowExtendedQuant && (m != 0xc0 || maxQuant > 255) {
+			t.Fatalf("expected baseline SOF and 8 bit quantization, got %x and %d", m, maxQuant)
+		}
+	}
+
+	d = encodeWithOptions(t, decodedImg, &Options{ColorSpace: ColorSpaceRGB})
+	info, err := GetJpegInfo(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ColorSpaceString != "rgb" {
+		t.Fatalf("expected rgb color space, got %s", info.ColorSpaceString)
+	}
+
+	invalid := []*Options{
+		{Quality: 101},
+		{Subsampling: 10},
+		{RestartInterval: -1},
+		{DCTMethod: 5},
+		{Smoothing: 101},
+		{ColorSpace: 3},
+	}
+	for _, o := range invalid {
+		if err := Encode(ioutil.Discard, decodedImg, o); err == nil {
+			t.Fatalf("expected error for %#v", o)
+		}
+	}
+}
+
+// dqtTables returns quantization tables (in zig-zag order) from DQT markers
+// of JPEG data d, indexed by table number
+func dqtTables(d []byte) map[int][]int {
+	res := map[int][]int{}
+	off := 2
+	for off+4 <= len(d) && d[off] == 0xff && d[off+1] != 0xda {
+		end := off + 2 + int(d[off+2])<<8 + int(d[off+3])
+		if d[off+1] == 0xdb {
+			p := off + 4
+			for p < end {
+				is16 := d[p]>>4 != 0
+				n := int(d[p] & 0xf)
+				p++
+				var t []int
+				for i := 0; i < 64; i++ {
+					if is16 {
+						t = append(t, int(d[p])<<8|int(d[p+1]))
+						p += 2
+					} else {
+						t = append(t, int(d[p]))
+						p++
+					}
+				}
+				res[n] = t
+			}
+		}
+		off = end
+	}
+	return res
+}
+
+// hideType hides the concrete type of an image so it's encoded with At()
+type hideType struct {
+	image.Image
+}
+
+func TestEncodeImageTypes(t *testing.T) {
+	b := image.Rect(-5, 3, 155, 123)
+	src := image.NewNRGBA(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			a := uint8(255)
+			if x > 100 {
+				a = uint8(x + y)
+			}
+			src.SetNRGBA(x, y, color.NRGBA{uint8(x * 3), uint8(y * 2), uint8(x ^ y), a})
+		}
+	}
+	ycbcr := image.NewYCbCr(b, image.YCbCrSubsampleRatio420)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.YCbCrModel.Convert(src.At(x, y)).(color.YCbCr)
+			ycbcr.Y[ycbcr.YOffset(x, y)] = c.Y
+			ycbcr.Cb[ycbcr.COffset(x, y)] = c.Cb
+			ycbcr.Cr[ycbcr.COffset(x, y)] = c.Cr
+		}
+	}
+	imgs := []draw.Image{
+		image.NewRGBA(b),
+		image.NewNRGBA(b),
+		image.NewRGBA64(b),
+		image.NewNRGBA64(b),
+		image.NewPaletted(b, palette.WebSafe),
+		image.NewCMYK(b),
+		image.NewGray(b),
+		image.NewGray16(b),
+	}
+	r := image.Rect(13, 17, 141, 111)
+	type subImager interface {
+		SubImage(r image.Rectangle) image.Image
+	}
+	for _, m := range imgs {
+		draw.Draw(m, b, src, b.Min, draw.Src)
+		sub := m.(subImager).SubImage(r)
+		got := encodeWithOptions(t, sub, nil)
+
+		// the same pixels in an image at (0, 0)
+		var ref draw.Image = image.NewRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+		if m.ColorModel() == color.GrayModel || m.ColorModel() == color.Gray16Model {
+			ref = image.NewGray(ref.Bounds())
+		} else if !bytes.Equal(got, encodeWithOptions(t, hideType{sub}, nil)) {
+			t.Fatalf("%T: data differs from encoding with At()", m)
+		}
+		draw.Draw(ref, ref.Bounds(), sub, r.Min, draw.Src)
+		if !bytes.Equal(got, encodeWithOptions(t, ref, nil)) {
+			t.Fatalf("%T: data differs from encoding the same pixels at (0, 0)", m)
+		}
+	}
+
+	// YCbCr is encoded as is, without conversion to RGB and back
+	sub := ycbcr.SubImage(r).(*image.YCbCr)
+	img, err := DecodeData(encodeWithOptions(t, sub, &Options{Quality: 100}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := DecodeData(encodeWithOptions(t, hideType{sub}, &Options{Quality: 100}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds() != image.Rect(0, 0, r.Dx(), r.Dy()) {
+		t.Fatalf("unexpected bounds %v", img.Bounds())
+	}
+	if d := maxPixDiff(img.(*image.RGBA), ref.(*image.RGBA)); d > 4 {
+		t.Fatalf("YCbCr image differs by %d", d)
+	}
+	if err := Encode(ioutil.Discard, sub, &Options{ColorSpace: ColorSpaceRGB}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEncodeQuantTables(t *testing.T) {
+	var flat QuantTable
+	for i := range flat {
+		flat[i] = 7
+	}
+	// at quality 50 basic tables are used as they are
+	o := &Options{Quality: 50, QuantTables: []QuantTable{flat}}
+	d := encodeWithOptions(t, decodedImg, o)
+	tables := dqtTables(d)
+	if len(tables) != 1 {
+		t.Fatalf("expected 1 quantization table, got %d", len(tables))
+	}
+	for _, v := range tables[0] {
+		if v != 7 {
+			t.Fatalf("unexpected quantization table %v", tables[0])
+		}
+	}
+
+	o = &Options{LumaQuality: 90, ChromaQuality: 30}
+	d = encodeWithOptions(t, decodedImg, o)
+	tables = dqtTables(d)
+	// DC values of standard tables scaled by libjpeg formula
+	if tables[0][0] != (16*20+50)/100 || tables[1][0] != (17*(5000/30)+50)/100 {
+		t.Fatalf("unexpected DC quantization values %d, %d", tables[0][0], tables[1][0])
+	}
+
+	// all components use the same table
+	o = &Options{QuantTableIndex: []int{0, 0, 0}}
+	d = encodeWithOptions(t, decodedImg, o)
+	if n := len(dqtTables(d)); n != 1 {
+		t.Fatalf("expected 1 quantization table, got %d", n)
+	}
+
+	invalid := []*Options{
+		{QuantTables: make([]QuantTable, 5)},
+		{QuantTables: []QuantTable{{}}},
+		{QuantTables: []QuantTable{flat}, QuantTableIndex: []int{1}},
+		{LumaQuality: 101},
+		{ChromaQuality: -1},
+	}
+	for _, o := range invalid {
+		if err := Encode(ioutil.Discard, decodedImg, o); err == nil {
+			t.Fatalf("expected error for %#v", o)
+		}
+	}
+}
+
+func TestJpegInfoTables(t *testing.T) {
+	d := encodeWithOptions(t, decodedImg, &Options{Quality: 83})
+	info, err := GetJpegInfo(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Quality != 83 {
+		t.Fatalf("estimated quality %d, expected 83", info.Quality)
+	}
+	if len(info.QuantTables) != 2 || len(info.QuantTableIndex) != 3 {
+		t.Fatalf("unexpected quantization tables %v %v", info.QuantTables, info.QuantTableIndex)
+	}
+	if info.QuantTables[0] != scaleQuantTable(&StdLumaQuantTable, 83) {
+		t.Fatalf("unexpected luma table %v", info.QuantTables[0])
+	}
+	if len(info.HuffmanTables) != 4 {
+		t.Fatalf("expected 4 Huffman tables, got %d", len(info.HuffmanTables))
+	}
+	for _, ht := range info.HuffmanTables {
+		n := 0
+		for _, b := range ht.Bits {
+			n += int(b)
+		}
+		if n == 0 || n != len(ht.Values) {
+			t.Fatalf("invalid Huffman table %#v", ht)
+		}
+	}
+
+	// re-encoding with source tables reproduces them exactly
+	o := &Options{SourceInfo: info, Quality: 20}
+	d2 := encodeWithOptions(t, decodedImg, o)
+	if !reflect.DeepEqual(dqtTables(d), dqtTables(d2)) {
+		t.Fatal("re-encoded quantization tables differ from the source")
+	}
+}
+
+func TestEncodeScanScript(t *testing.T) {
+	// standard script is the same as jpeg_simple_progression()
+	d1 := encodeWithOptions(t, decodedImg, &Options{Progressive: true})
+	d2 := encodeWithOptions(t, decodedImg, &Options{ScanScript: StandardScanScript(3)})
+	if !bytes.Equal(d1, d2) {
+		t.Fatal("standard scan script differs from jpeg_simple_progression()")
+	}
+	d := encodeWithOptions(t, decodedImg, &Options{ScanScript: SpectralScanScript(3)})
+	if n := bytes.Count(d, []byte{0xff, 0xda}); n != 5 {
+		t.Fatalf("expected 5 scans, got %d", n)
+	}
+	gray := image.NewGray(image.Rect(0, 0, 33, 17))
+	encodeWithOptions(t, gray, &Options{ScanScript: StandardScanScript(1)})
+	encodeWithOptions(t, gray, &Options{ScanScript: SpectralScanScript(1)})
+
+	invalid := []ScanScript{
+		// component out of range
+		{{[]int{0, 1, 3}, 0, 0, 0, 0}},
+		// components not in order
+		{{[]int{1, 0, 2}, 0, 0, 0, 0}},
+		// DC and AC mixed
+		{{[]int{0, 1, 2}, 0, 5, 0, 0}},
+		// AC with more than one component
+		{{[]int{0, 1, 2}, 0, 0, 0, 0}, {[]int{0, 1}, 1, 63, 0, 0}},
+		// AC before DC
+		{{[]int{0}, 1, 63, 0, 0}, {[]int{0, 1, 2}, 0, 0, 0, 0}},
+		// invalid successive approximation
+		{{[]int{0, 1, 2}, 0, 0, 0, 2}, {[]int{0, 1, 2}, 0, 0, 1, 0}},
+		// component 2 never coded
+		{{[]int{0, 1}, 0, 0, 0, 0}},
+	}
+	for _, script := range invalid {
+		if err := Encode(ioutil.Discard, decodedImg, &Options{ScanScript: script}); err == nil {
+			t.Fatalf("expected error for %v", script)
+		}
+	}
+	// scripts for color images don't work for grayscale
+	if err := Encode(ioutil.Discard, gray, &Options{ScanScript: StandardScanScript(3)}); err == nil {
+		t.Fatal("expected error for gray image")
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	corrupt := append([]byte{}, imgData...)
+	// destroy SOF marker
+	off := findMarker(corrupt, 0xc0)
+	if off < 0 {
+		t.Fatal("no SOF0 marker")
+	}
+	corrupt[off+1] = 0xcf
+	inputs := [][]byte{
+		nil,
+		[]byte("not a jpeg"),
+		imgData[:2],
+		imgData[:20],
+		corrupt,
+	}
+	for i, d := range inputs {
+		if _, err := DecodeData(d); err == nil {
+			t.Fatalf("%d: expected error from DecodeData()", i)
+		}
+		if _, err := GetJpegInfo(d); err == nil {
+			t.Fatalf("%d: expected error from GetJpegInfo()", i)
+		}
+		if _, err := Decode(bytes.NewReader(d)); err == nil {
+			t.Fatalf("%d: expected error from Decode()", i)
+		}
+		if _, err := DecodeConfig(bytes.NewReader(d)); err == nil {
+			t.Fatalf("%d: expected error from DecodeConfig()", i)
+		}
+	}
+	// libjpeg can't encode images wider than 65500 pixels
+	img := image.NewGray(image.Rect(0, 0, 70000, 1))
+	if err := Encode(ioutil.Discard, img, nil); err == nil {
+		t.Fatal("expected error from Encode()")
+	}
+}
+
+func TestErrorKinds(t *testing.T) {
+	// data ends right before the first scan
+	sos := findMarker(imgData, 0xda)
+	if sos < 0 {
+		t.Fatal("no SOS marker")
+	}
+	tests := []struct {
+		d    []byte
+		want error
+	}{
+		{[]byte("not a jpeg"), ErrNotJPEG},
+		{nil, ErrNotJPEG},
+		{imgData[:2], ErrTruncated},
+		{imgData[:sos], ErrTruncated},
+	}
+	for i, tc := range tests {
+		_, err := DecodeData(tc.d)
+		if !errors.Is(err, tc.want) {
+			t.Fatalf("%d: DecodeData(): expected %v, got %v", i, tc.want, err)
+		}
+		var jerr *Error
+		if !errors.As(err, &jerr) || jerr.Phase != PhaseHeader {
+			t.Fatalf("%d: DecodeData(): expected header *Error, got %#v", i, err)
+		}
+		if _, err = Decode(bytes.NewReader(tc.d)); !errors.Is(err, tc.want) {
+			t.Fatalf("%d: Decode(): expected %v, got %v", i, tc.want, err)
+		}
+		if _, err = GetJpegInfo(tc.d); !errors.Is(err, tc.want) {
+			t.Fatalf("%d: GetJpegInfo(): expected %v, got %v", i, tc.want, err)
+		}
+	}
+
+	img := image.NewGray(image.Rect(0, 0, 70000, 1))
+	err := Encode(ioutil.Discard, img, nil)
+	var jerr *Error
+	if !errors.Is(err, ErrInvalidDimensions) || !errors.As(err, &jerr) || jerr.Phase != PhaseEncode {
+		t.Fatalf("expected encode ErrInvalidDimensions, got %v", err)
+	}
+	err = Encode(ioutil.Discard, image.NewGray(image.Rectangle{}), nil)
+	if !errors.Is(err, ErrInvalidDimensions) {
+		t.Fatalf("expected ErrInvalidDimensions, got %v", err)
+	}
+	if errors.Is(err, ErrNotJPEG) {
+		t.Fatal("error matches a wrong sentinel")
+	}
+}
+
+func TestDecoderReuse(t *testing.T) {
+	dec, err := NewDecoder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dec.Close()
+
+	progressive := encodeWithOptions(t, decodedImg, &Options{Progressive: true})
+	gray := image.NewGray(decodedImg.Bounds())
+	draw.Draw(gray, gray.Bounds(), decodedImg, image.Point{}, draw.Src)
+	grayData := encodeWithOptions(t, gray, nil)
+	inputs := []struct {
+		d       []byte
+		o       *DecodeOptions
+		wantErr bool
+	}{
+		{imgData, nil, false},
+		{[]byte("not a jpeg"), nil, true},
+		{progressive, &DecodeOptions{MaxMemory: 1 << 20}, true},
+		{progressive, nil, false},
+		{progressive, &DecodeOptions{MaxScans: 3}, true},
+		{progressive, &DecodeOptions{ScaleNum: 1, ScaleDenom: 2}, false},
+		{grayData, nil, false},
+		{imgData[:len(imgData)/2], &DecodeOptions{Strict: true}, true},
+		{imgData, &DecodeOptions{Strict: true}, false},
+	}
+	for i, in := range inputs {
+		img, err := dec.Decode(in.d, in.o)
+		if in.wantErr {
+			if err == nil {
+				t.Fatalf("%d: expected error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		expected, err := DecodeDataWithOptions(in.d, in.o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !pixEqual(img, expected) {
+			t.Fatalf("%d: image differs from DecodeDataWithOptions()", i)
+		}
+	}
+}
+
+func TestEncoderReuse(t *testing.T) {
+	enc, err := NewEncoder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer enc.Close()
+
+	gray := image.NewGray(decodedImg.Bounds())
+	draw.Draw(gray, gray.Bounds(), decodedImg, image.Point{}, draw.Src)
+	inputs := []struct {
+		img image.Image
+		o   *Options
+	}{
+		{decodedImg, nil},
+		{gray, &Options{Quality: 90}},
+		{decodedImg, &Options{ScanScript: SpectralScanScript(3)}},
+		{decodedImg, &Options{Progressive: true, OptimizeHuffman: true}},
+		{gray, &Options{ScanScript: StandardScanScript(1)}},
+		{decodedImg, &Options{Subsampling: Subsampling444, Arithmetic: true}},
+	}
+	for i, in := range inputs {
+		var buf bytes.Buffer
+		if err := enc.Encode(&buf, in.img, in.o); err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		expected := encodeWithOptions(t, in.img, in.o)
+		if !bytes.Equal(buf.Bytes(), expected) {
+			t.Fatalf("%d: data differs from Encode()", i)
+		}
+		if err := enc.Encode(&failingWriter{}, in.img, in.o); err != errWrite {
+			t.Fatalf("%d: expected %v, got %v", i, errWrite, err)
+		}
+	}
+
+	prefix := []byte("prefix")
+	d, err := AppendEncode(prefix, decodedImg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(d, prefix) || !bytes.Equal(d[len(prefix):], encodeWithOptions(t, decodedImg, nil)) {
+		t.Fatal("unexpected AppendEncode() result")
+	}
+	d, err = enc.AppendEncode(d[:0], gray, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(d, encodeWithOptions(t, gray, nil)) {
+		t.Fatal("unexpected Encoder.AppendEncode() result")
+	}
+}
+
+// failingWriter fails with errWrite after n successful writes
+type failingWriter struct {
+	n int
+}
+
+var errWrite = errors.New("write failed")
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.n == 0 {
+		return 0, errWrite
+	}
+	w.n--
+	return len(p), nil
+}
+
+func TestEncodeWriter(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Encode(&buf, decodedImg, &Options{Quality: 90}); err != nil {
+		t.Fatal(err)
+	}
+	img, err := DecodeData(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds() != decodedImg.Bounds() {
+		t.Fatalf("unexpected bounds %v", img.Bounds())
+	}
+}
+
+func TestEncodeWriterError(t *testing.T) {
+	// fails while emptying a full buffer
+	err := Encode(&failingWriter{n: 1}, decodedImg, nil)
+	if err != errWrite {
+		t.Fatalf("expected %v, got %v", errWrite, err)
+	}
+	// a small image fits in one buffer so it fails when it's flushed at the end
+	img := image.NewGray(image.Rect(0, 0, 8, 8))
+	err = Encode(&failingWriter{}, img, nil)
+	if err != errWrite {
+		t.Fatalf("expected %v, got %v", errWrite, err)
+	}
+}
+
 func BenchmarkDecode(b *testing.B) {
 	var err error
 	for n := 0; n < b.N; n++ {
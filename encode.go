@@ -1,161 +1,573 @@
 package golibjpegturbo
 
 /*
-#include <stddef.h>
-#include <stdio.h>
-#include <stdlib.h>
-#include <jpeglib.h>
-typedef unsigned char *PUCHAR;
-
-void error_panic(j_common_ptr cinfo);
-
-typedef struct {
-unsigned char *buf;
-unsigned long buf_size;
-} mem_helper;
-
-mem_helper *alloc_mem_helper();
+#include "jpeg_common.h"
 */
 import "C"
 
 import (
+	"context"
 	"fmt"
 	"image"
+	"image/color"
 	"io"
+	"runtime/cgo"
 	"unsafe"
 )
 
 // DefaultQuality is the default quality encoding parameter.
 const DefaultQuality = 75
 
+// writeBufferSize is the size of the chunks in which Encode writes compressed
+// data to io.Writer
+const writeBufferSize = 32 * 1024
+
+// Subsampling is the chroma subsampling of YCbCr JPEG image.
+type Subsampling int
+
+const (
+	// Subsampling420 halves chroma resolution horizontally and vertically
+	Subsampling420 Subsampling = iota
+	// Subsampling444 keeps full chroma resolution
+	Subsampling444
+	// Subsampling422 halves chroma resolution horizontally
+	Subsampling422
+	// Subsampling440 halves chroma resolution vertically
+	Subsampling440
+	// Subsampling411 quarters chroma resolution horizontally
+	Subsampling411
+)
+
+// DCTMethod is the DCT algorithm used by libjpeg.
+type DCTMethod int
+
+const (
+	// DCTIslow is accurate integer method
+	DCTIslow DCTMethod = iota
+	// DCTIfast is less accurate integer method
+	DCTIfast
+	// DCTFloat is floating-point method
+	DCTFloat
+)
+
+// JpegColorSpace is the color space in which color images are stored in
+// JPEG file.
+type JpegColorSpace int
+
+const (
+	// ColorSpaceYCbCr is the standard JPEG color space
+	ColorSpaceYCbCr JpegColorSpace = iota
+	// ColorSpaceRGB stores RGB without conversion, which is better for
+	// graphics but results in much bigger files
+	ColorSpaceRGB
+)
+
 // Options are the encoding parameters.
-// Quality ranges from 1 to 100 inclusive, higher is better.
+//
+// Quality ranges from 1 to 100 inclusive, higher is better. 0 means
+// DefaultQuality.
+//
+// Subsampling is only used for YCbCr color space. RGB and grayscale images
+// are never subsampled. *image.YCbCr images are encoded from their planes
+// as they are, without color conversion, keeping their own subsampling, so
+// Subsampling and Smoothing are ignored. This isn't possible for
+// subsample ratios JPEG doesn't support, or sub-images that don't start
+// at a chroma sample, which are converted like other images.
+//
+// Progressive creates progressive JPEG with jpeg_simple_progression().
+// ScanScript allows full control over scans, see ScanScript.
+//
+// OptimizeHuffman computes optimal Huffman tables for the image, which
+// makes files smaller at the cost of slower encoding.
+//
+// Arithmetic uses arithmetic coding instead of Huffman coding. It makes
+// files smaller but some decoders don't support it.
+//
+// RestartInterval is the number of MCUs between restart markers,
+// 0 means no restart markers. Maximum is 65535.
+//
+// Smoothing ranges from 0 (no smoothing) to 100.
+//
+// Quantization table values are limited to 8 bits, so that low quality
+// images can be decoded by baseline-only decoders. AllowExtendedQuant
+// allows 16 bit values, which makes Encode write extended sequential
+// (SOF1) JPEG for low quality.
+//
+// QuantTables and LumaQuality/ChromaQuality customize quantization,
+// see QuantTable.
+//
+// SourceInfo, if not nil, makes Encode use exactly the same quantization
+// tables as the JPEG image described by it (see GetJpegInfo). Re-encoding
+// a decoded image with its own tables avoids both guessing the quality and
+// additional generation loss. Quality, LumaQuality, ChromaQuality,
+// QuantTables and QuantTableIndex are ignored in this mode. Huffman tables
+// are not reused because they might not cover all symbols of the new image,
+// use OptimizeHuffman to get optimal tables.
+//
+// Progress, if not nil, is called by Encode and EncodeContext as encoding
+// progresses. It's called often, so it should be fast.
 type Options struct {
-	Quality int
-}
-
-// Encode writes the Image m to w in JPEG 4:2:0 baseline format with the given
-// options. Default parameters are used if a nil *Options is passed.
-func Encode(w io.Writer, m image.Image, o *Options) (err error) {
-	defer func() {
-		if r := recover(); r != nil {
-			var ok bool
-			err, ok = r.(error)
-			if !ok {
-				err = fmt.Errorf("JPEG error: %v", r)
-			}
+	Quality            int
+	Subsampling        Subsampling
+	Progressive        bool
+	OptimizeHuffman    bool
+	Arithmetic         bool
+	RestartInterval    int
+	DCTMethod          DCTMethod
+	Smoothing          int
+	AllowExtendedQuant bool
+	ColorSpace         JpegColorSpace
+	QuantTables        []QuantTable
+	QuantTableIndex    []int
+	LumaQuality        int
+	ChromaQuality      int
+	SourceInfo         *JpegInfo
+	ScanScript         ScanScript
+	Progress           func(Progress)
+}
+
+func (o *Options) validate() error {
+	if o.Quality < 0 || o.Quality > 100 {
+		return fmt.Errorf("invalid quality %d (must be 0 to 100)", o.Quality)
+	}
+	if o.Subsampling < Subsampling420 || o.Subsampling > Subsampling411 {
+		return fmt.Errorf("invalid subsampling %d", o.Subsampling)
+	}
+	if o.RestartInterval < 0 || o.RestartInterval > 65535 {
+		return fmt.Errorf("invalid restart interval %d (must be 0 to 65535)", o.RestartInterval)
+	}
+	if o.DCTMethod < DCTIslow || o.DCTMethod > DCTFloat {
+		return fmt.Errorf("invalid DCT method %d", o.DCTMethod)
+	}
+	if o.Smoothing < 0 || o.Smoothing > 100 {
+		return fmt.Errorf("invalid smoothing %d (must be 0 to 100)", o.Smoothing)
+	}
+	if o.ColorSpace != ColorSpaceYCbCr && o.ColorSpace != ColorSpaceRGB {
+		return fmt.Errorf("invalid color space %d", o.ColorSpace)
+	}
+	return o.validateQuant()
+}
+
+// luma sampling factors for each Subsampling, chroma is always 1x1
+var subsamplingFactors = [...][2]int{
+	Subsampling420: {2, 2},
+	Subsampling444: {1, 1},
+	Subsampling422: {2, 1},
+	Subsampling440: {1, 2},
+	Subsampling411: {4, 1},
+}
+
+var dctMethods = [...]C.J_DCT_METHOD{
+	DCTIslow: C.JDCT_ISLOW,
+	DCTIfast: C.JDCT_IFAST,
+	DCTFloat: C.JDCT_FLOAT,
+}
+
+func cBool(b bool) C.boolean {
+	if b {
+		return C.TRUE
+	}
+	return C.FALSE
+}
+
+// compInfo returns cinfo.comp_info as a slice
+func compInfo(cinfo *C.struct_jpeg_compress_struct) []C.jpeg_component_info {
+	return unsafe.Slice(cinfo.comp_info, int(cinfo.num_components))
+}
+
+// applyEncodeOptions sets compression parameters in cinfo. in_color_space
+// must already be set and o must be valid, except for ScanScript, which
+// depends on the number of components.
+func applyEncodeOptions(cinfo *C.struct_jpeg_compress_struct, o *Options) error {
+	if C.try_set_defaults(cinfo) == 0 {
+		return jpegError(cinfo.err, PhaseEncode)
+	}
+	isGray := cinfo.in_color_space == C.JCS_GRAYSCALE
+	if !isGray && o.ColorSpace == ColorSpaceRGB {
+		// also sets all sampling factors to 1x1
+		if C.try_set_colorspace(cinfo, C.JCS_RGB) == 0 {
+			return jpegError(cinfo.err, PhaseEncode)
+		}
+	}
+
+	quality := o.Quality
+	if quality == 0 {
+		quality = DefaultQuality
+	}
+	if C.try_set_quality(cinfo, C.int(quality), cBool(!o.AllowExtendedQuant)) == 0 {
+		return jpegError(cinfo.err, PhaseEncode)
+	}
+
+	if cinfo.jpeg_color_space == C.JCS_YCbCr {
+		comps := compInfo(cinfo)
+		f := subsamplingFactors[o.Subsampling]
+		comps[0].h_samp_factor = C.int(f[0])
+		comps[0].v_samp_factor = C.int(f[1])
+		for i := 1; i < len(comps); i++ {
+			comps[i].h_samp_factor = 1
+			comps[i].v_samp_factor = 1
+		}
+	}
+
+	// depends on color space so must be done after jpeg_set_colorspace()
+	if len(o.ScanScript) > 0 {
+		if err := o.ScanScript.validate(int(cinfo.num_components)); err != nil {
+			return err
+		}
+		if err := o.ScanScript.install(cinfo); err != nil {
+			return err
+		}
+	} else if o.Progressive {
+		if C.try_simple_progression(cinfo) == 0 {
+			return jpegError(cinfo.err, PhaseEncode)
 		}
-	}()
+	}
+	cinfo.optimize_coding = cBool(o.OptimizeHuffman)
+	cinfo.arith_code = cBool(o.Arithmetic)
+	cinfo.restart_interval = C.uint(o.RestartInterval)
+	cinfo.dct_method = dctMethods[o.DCTMethod]
+	cinfo.smoothing_factor = C.int(o.Smoothing)
+	return applyQuantOptions(cinfo, o)
+}
+
+// newCompress allocates and initializes libjpeg compressor. It must be
+// released with destroyCompress.
+func newCompress() (*C.struct_jpeg_compress_struct, error) {
+	cinfo := (*C.struct_jpeg_compress_struct)(C.calloc(1, C.size_t(unsafe.Sizeof(C.struct_jpeg_compress_struct{}))))
+	if cinfo == nil {
+		return nil, errOutOfMemory
+	}
+	cinfo.err = C.alloc_error_mgr()
+	if cinfo.err == nil {
+		C.free(unsafe.Pointer(cinfo))
+		return nil, errOutOfMemory
+	}
+	if C.try_create_compress(cinfo) == 0 {
+		err := jpegError(cinfo.err, PhaseEncode)
+		destroyCompress(cinfo)
+		return nil, err
+	}
+	return cinfo, nil
+}
+
+// destroyCompress releases cinfo. It's safe to call at any point, including
+// after libjpeg failed with an error.
+func destroyCompress(cinfo *C.struct_jpeg_compress_struct) {
+	C.jpeg_destroy_compress(cinfo)
+	C.free(unsafe.Pointer(cinfo.err))
+	C.free(unsafe.Pointer(cinfo))
+}
+
+// writeScanline writes one scanline from row
+func writeScanline(cinfo *C.struct_jpeg_compress_struct, row *C.JSAMPROW) error {
+	if C.try_write_scanlines(cinfo, row, 1) == 0 {
+		return jpegError(cinfo.err, PhaseEncode)
+	}
+	return nil
+}
+
+// Encode writes the Image m to w in JPEG format with the given options.
+// Default parameters (4:2:0 baseline YCbCr) are used if a nil *Options is
+// passed. An error returned by w.Write is returned by Encode.
+func Encode(w io.Writer, m image.Image, o *Options) error {
+	return EncodeContext(context.Background(), w, m, o)
+}
+
+// EncodeContext is like Encode but encoding is aborted when ctx is done, in
+// which case ctx.Err() is returned.
+func EncodeContext(ctx context.Context, w io.Writer, m image.Image, o *Options) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	enc, err := NewEncoder()
+	if err != nil {
+		return err
+	}
+	defer enc.Close()
+	return enc.EncodeContext(ctx, w, m, o)
+}
+
+// AppendEncode appends the Image m in JPEG format, encoded with the given
+// options, to dst and returns the extended buffer.
+func AppendEncode(dst []byte, m image.Image, o *Options) ([]byte, error) {
+	enc, err := NewEncoder()
+	if err != nil {
+		return dst, err
+	}
+	defer enc.Close()
+	return enc.AppendEncode(dst, m, o)
+}
+
+// appendWriter appends written data to b
+type appendWriter struct {
+	b []byte
+}
+
+func (w *appendWriter) Write(p []byte) (int, error) {
+	w.b = append(w.b, p...)
+	return len(p), nil
+}
+
+// Encoder encodes JPEG images, keeping libjpeg compressor and buffers
+// between calls. When encoding many images, it's faster than Encode which
+// sets them up for every image.
+//
+// Encoder is not safe for concurrent use, but it can be kept per goroutine
+// or in a sync.Pool. It must be released with Close.
+type Encoder struct {
+	cinfo *C.struct_jpeg_compress_struct
+	buf   lineBuffer
+}
 
+// NewEncoder returns a new Encoder.
+func NewEncoder() (*Encoder, error) {
+	cinfo, err := newCompress()
+	if err != nil {
+		return nil, err
+	}
+	return &Encoder{cinfo: cinfo}, nil
+}
+
+// Close releases libjpeg compressor and buffers. The Encoder can't be used
+// after that.
+func (enc *Encoder) Close() {
+	if enc.cinfo != nil {
+		destroyCompress(enc.cinfo)
+		enc.cinfo = nil
+	}
+	enc.buf.free()
+}
+
+// Encode writes the Image m to w in JPEG format with the given options,
+// like the package-level Encode.
+func (enc *Encoder) Encode(w io.Writer, m image.Image, o *Options) error {
+	return enc.EncodeContext(context.Background(), w, m, o)
+}
+
+// AppendEncode appends the Image m in JPEG format, encoded with the given
+// options, to dst and returns the extended buffer.
+func (enc *Encoder) AppendEncode(dst []byte, m image.Image, o *Options) ([]byte, error) {
+	w := &appendWriter{b: dst}
+	if err := enc.Encode(w, m, o); err != nil {
+		return dst, err
+	}
+	return w.b, nil
+}
+
+// EncodeContext is like Encode but encoding is aborted when ctx is done, in
+// which case ctx.Err() is returned.
+func (enc *Encoder) EncodeContext(ctx context.Context, w io.Writer, m image.Image, o *Options) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	b := m.Bounds()
 	dx := b.Dx()
 	dy := b.Dy()
 	if dx <= 0 || dy <= 0 {
-		return fmt.Errorf("image with invalid size, dx: %d, dy: %d (both must be > 0)", dx, dy)
+		return fmt.Errorf("%w: image with invalid size, dx: %d, dy: %d (both must be > 0)", ErrInvalidDimensions, dx, dy)
 	}
 
-	quality := 75
-	if o != nil {
-		quality = o.Quality
+	if o == nil {
+		o = &Options{}
+	}
+	if err := o.validate(); err != nil {
+		return err
 	}
 
-	cinfoSize := C.size_t(unsafe.Sizeof(C.struct_jpeg_compress_struct{}))
-
-	cinfo := (*C.struct_jpeg_compress_struct)(C.malloc(cinfoSize))
-	defer C.free(unsafe.Pointer(cinfo))
+	cinfo := enc.cinfo
+	// makes the compressor ready for encoding the next image
+	defer C.jpeg_abort_compress(cinfo)
 
-	cinfoErrSize := C.size_t(unsafe.Sizeof(C.struct_jpeg_error_mgr{}))
-	cinfo.err = (*C.struct_jpeg_error_mgr)(C.malloc(cinfoErrSize))
-	defer C.free(unsafe.Pointer(cinfo.err))
+	// compressed data is written to w in chunks as libjpeg produces it.
+	// C code can't hold a Go pointer so it only gets a handle to dest
+	dest := &writerDest{w: w}
+	h := cgo.NewHandle(dest)
+	defer h.Delete()
+	if C.try_writer_dest(cinfo, C.uintptr_t(h), writeBufferSize) == 0 {
+		return jpegError(cinfo.err, PhaseEncode)
+	}
 
-	C.jpeg_std_error(cinfo.err)
-	cinfo.err.error_exit = (*[0]byte)(C.error_panic)
+	pm, err := watchProgress(C.j_common_ptr(unsafe.Pointer(cinfo)), ctx, o.Progress, PhaseEncode)
+	if err != nil {
+		return err
+	}
+	if pm != nil {
+		defer pm.release()
+	}
 
-	memHelper := C.alloc_mem_helper()
-	C.jpeg_CreateCompress(cinfo, C.JPEG_LIB_VERSION, cinfoSize)
-	C.jpeg_mem_dest(cinfo, &memHelper.buf, &memHelper.buf_size)
+	err = encode(cinfo, m, o, &enc.buf)
+	if dest.err != nil {
+		// libjpeg failed because of w, which is more useful to report
+		return dest.err
+	}
+	if pm != nil && pm.err != nil {
+		// libjpeg was aborted because ctx is done
+		return pm.err
+	}
+	return err
+}
 
-	nBytes := dx * 3 // for a line, 3 bytes per pixel
+// encode compresses m, cinfo's destination manager has already been set up.
+// Scanlines are written from lb.
+func encode(cinfo *C.struct_jpeg_compress_struct, m image.Image, o *Options, lb *lineBuffer) error {
+	b := m.Bounds()
+	dx := b.Dx()
+	dy := b.Dy()
 	cinfo.image_width = C.JDIMENSION(dx)
 	cinfo.image_height = C.JDIMENSION(dy)
 
-	gray, isGray := m.(*image.Gray)
-	rgba, isRgba := m.(*image.RGBA)
-
-	cinfo.input_components = 3
-	cinfo.in_color_space = C.JCS_RGB
+	colorSpace, nComp, fill := scanlineSource(m, o)
+	cinfo.in_color_space = colorSpace
+	cinfo.input_components = C.int(nComp)
 
-	if isGray {
-		nBytes = dx
-		cinfo.input_components = 1
-		cinfo.in_color_space = C.JCS_GRAYSCALE
+	if err := applyEncodeOptions(cinfo, o); err != nil {
+		return err
 	}
-	// Note: for more speed could try to go directly to JCS_EXT_RGBA but not
-	// sure if libjpeg matches Go and treats JCS_EXT_RGBA as alpha-premultipled
-	if isRgba {
-		nBytes = dx * 3
-		cinfo.input_components = 3
-		cinfo.in_color_space = C.JCS_RGB
+	factors, fillRaw, raw := rawSource(m, o)
+	if raw {
+		setRawYCbCr(cinfo, factors)
+	}
+	if C.try_start_compress(cinfo) == 0 {
+		return jpegError(cinfo.err, PhaseEncode)
 	}
 
-	C.jpeg_set_defaults(cinfo)
-	C.jpeg_set_quality(cinfo, C.int(quality), C.TRUE)
-	C.jpeg_start_compress(cinfo, C.TRUE)
+	if raw {
+		if err := writeRawYCbCr(cinfo, fillRaw, lb); err != nil {
+			return err
+		}
+	} else {
+		nBytes := dx * nComp
+		bufBytes := lb.get(nBytes)
+		rowPtr := C.JSAMPROW(bufBytes)
+		buf := sliceFromCBytes(bufBytes, nBytes)
+		for y := 0; y < dy; y++ {
+			fill(buf, b.Min.Y+y)
+			if err := writeScanline(cinfo, &rowPtr); err != nil {
+				return err
+			}
+		}
+	}
 
-	bufBytes := C.malloc(C.size_t(nBytes))
-	rowPtr := C.JSAMPROW(bufBytes)
-	buf := sliceFromCBytes(bufBytes, nBytes)
+	// flushes the remaining data, so errors from w can also happen here
+	if C.try_finish_compress(cinfo) == 0 {
+		return jpegError(cinfo.err, PhaseEncode)
+	}
+	return nil
+}
 
-	if isGray {
-		for y := 0; y < dy; y++ {
-			off := y * gray.Stride
-			copy(buf[:], gray.Pix[off:off+nBytes])
-			C.jpeg_write_scanlines(cinfo, &rowPtr, 1)
+// scanlineSource returns the color space and the number of components of
+// scanlines for m, and a function that fills buf with row y (in m's
+// coordinates) of m.
+//
+// Pixels with alpha are composited on black, like colors returned by At().
+// Pixels of YCbCr images are given to libjpeg as they are, unless RGB
+// color space is requested.
+func scanlineSource(m image.Image, o *Options) (C.J_COLOR_SPACE, int, func(buf []byte, y int)) {
+	b := m.Bounds()
+	dx := b.Dx()
+	switch m := m.(type) {
+	case *image.Gray:
+		return C.JCS_GRAYSCALE, 1, func(buf []byte, y int) {
+			off := m.PixOffset(b.Min.X, y)
+			copy(buf, m.Pix[off:off+dx])
 		}
-	} else if isRgba {
-		for y := 0; y < dy; y++ {
-			off := y * rgba.Stride
-			p := rgba.Pix[off:]
-			dstOff := 0
-			srcOff := 0
+	case *image.Gray16:
+		return C.JCS_GRAYSCALE, 1, func(buf []byte, y int) {
+			p := m.Pix[m.PixOffset(b.Min.X, y):]
 			for x := 0; x < dx; x++ {
-				buf[dstOff] = p[srcOff]
-				dstOff++
-				srcOff++
-				buf[dstOff] = p[srcOff]
-				dstOff++
-				srcOff++
-				buf[dstOff] = p[srcOff]
-				dstOff++
-				srcOff += 2
+				buf[x] = p[x*2]
 			}
-
-			C.jpeg_write_scanlines(cinfo, &rowPtr, 1)
 		}
-	} else {
-		for y := 0; y < dy; y++ {
-			off := 0
+	case *image.YCbCr:
+		if o.ColorSpace == ColorSpaceRGB {
+			break
+		}
+		return C.JCS_YCbCr, 3, func(buf []byte, y int) {
 			for x := 0; x < dx; x++ {
-				r, g, b, _ := m.At(x, y).RGBA()
-				buf[off] = byte(r >> 8)
-				off++
-				buf[off] = byte(g >> 8)
-				off++
-				buf[off] = byte(b >> 8)
-				off++
+				yi := m.YOffset(b.Min.X+x, y)
+				ci := m.COffset(b.Min.X+x, y)
+				buf[x*3] = m.Y[yi]
+				buf[x*3+1] = m.Cb[ci]
+				buf[x*3+2] = m.Cr[ci]
+			}
+		}
+	// Note: for more speed could try to go directly to JCS_EXT_RGBA but not
+	// sure if libjpeg matches Go and treats JCS_EXT_RGBA as alpha-premultipled
+	case *image.RGBA:
+		return C.JCS_RGB, 3, func(buf []byte, y int) {
+			p := m.Pix[m.PixOffset(b.Min.X, y):]
+			for x := 0; x < dx; x++ {
+				buf[x*3] = p[x*4]
+				buf[x*3+1] = p[x*4+1]
+				buf[x*3+2] = p[x*4+2]
+			}
+		}
+	case *image.NRGBA:
+		return C.JCS_RGB, 3, func(buf []byte, y int) {
+			p := m.Pix[m.PixOffset(b.Min.X, y):]
+			for x := 0; x < dx; x++ {
+				// same as color.NRGBA.RGBA() >> 8
+				a := uint32(p[x*4+3])
+				buf[x*3] = uint8(uint32(p[x*4]) * 0x101 * a / 0xff >> 8)
+				buf[x*3+1] = uint8(uint32(p[x*4+1]) * 0x101 * a / 0xff >> 8)
+				buf[x*3+2] = uint8(uint32(p[x*4+2]) * 0x101 * a / 0xff >> 8)
+			}
+		}
+	case *image.RGBA64:
+		return C.JCS_RGB, 3, func(buf []byte, y int) {
+			p := m.Pix[m.PixOffset(b.Min.X, y):]
+			for x := 0; x < dx; x++ {
+				// high bytes of big-endian 16-bit values
+				buf[x*3] = p[x*8]
+				buf[x*3+1] = p[x*8+2]
+				buf[x*3+2] = p[x*8+4]
+			}
+		}
+	case *image.NRGBA64:
+		return C.JCS_RGB, 3, func(buf []byte, y int) {
+			p := m.Pix[m.PixOffset(b.Min.X, y):]
+			for x := 0; x < dx; x++ {
+				// same as color.NRGBA64.RGBA() >> 8
+				q := p[x*8:]
+				a := uint32(q[6])<<8 | uint32(q[7])
+				buf[x*3] = uint8((uint32(q[0])<<8 | uint32(q[1])) * a / 0xffff >> 8)
+				buf[x*3+1] = uint8((uint32(q[2])<<8 | uint32(q[3])) * a / 0xffff >> 8)
+				buf[x*3+2] = uint8((uint32(q[4])<<8 | uint32(q[5])) * a / 0xffff >> 8)
+			}
+		}
+	case *image.Paletted:
+		// indexes outside of the palette are black
+		var pal [256][3]uint8
+		for i, c := range m.Palette {
+			if i == len(pal) {
+				break
+			}
+			cr, cg, cb, _ := c.RGBA()
+			pal[i] = [3]uint8{uint8(cr >> 8), uint8(cg >> 8), uint8(cb >> 8)}
+		}
+		return C.JCS_RGB, 3, func(buf []byte, y int) {
+			p := m.Pix[m.PixOffset(b.Min.X, y):]
+			for x := 0; x < dx; x++ {
+				c := &pal[p[x]]
+				buf[x*3] = c[0]
+				buf[x*3+1] = c[1]
+				buf[x*3+2] = c[2]
+			}
+		}
+	case *image.CMYK:
+		return C.JCS_RGB, 3, func(buf []byte, y int) {
+			p := m.Pix[m.PixOffset(b.Min.X, y):]
+			for x := 0; x < dx; x++ {
+				buf[x*3], buf[x*3+1], buf[x*3+2] = color.CMYKToRGB(p[x*4], p[x*4+1], p[x*4+2], p[x*4+3])
 			}
-
-			C.jpeg_write_scanlines(cinfo, &rowPtr, 1)
 		}
 	}
-
-	C.jpeg_finish_compress(cinfo)
-	C.jpeg_destroy_compress(cinfo)
-
-	outBs := C.GoBytes(unsafe.Pointer(memHelper.buf), C.int(memHelper.buf_size))
-	w.Write(outBs)
-	C.free(unsafe.Pointer(memHelper.buf))
-	C.free(bufBytes)
-	C.free(unsafe.Pointer(memHelper))
-	return nil
+	return C.JCS_RGB, 3, func(buf []byte, y int) {
+		for x := 0; x < dx; x++ {
+			cr, cg, cb, _ := m.At(b.Min.X+x, y).RGBA()
+			buf[x*3] = byte(cr >> 8)
+			buf[x*3+1] = byte(cg >> 8)
+			buf[x*3+2] = byte(cb >> 8)
+		}
+	}
 }
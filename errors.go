@@ -0,0 +1,134 @@
+package golibjpegturbo
+
+/*
+#include "jpeg_common.h"
+#include <jerror.h>
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"unsafe"
+)
+
+var (
+	// ErrNotJPEG means that the data is not a JPEG image
+	ErrNotJPEG = errors.New("JPEG: not a JPEG image")
+	// ErrTruncated means that JPEG data ended prematurely
+	ErrTruncated = errors.New("JPEG: truncated data")
+	// ErrUnsupportedColorSpace means that the color space or number of
+	// components of the image is not supported
+	ErrUnsupportedColorSpace = errors.New("JPEG: unsupported color space")
+	// ErrInvalidDimensions means that the image is empty or too big
+	ErrInvalidDimensions = errors.New("JPEG: invalid image dimensions")
+	// ErrLimitExceeded means that decoding the image would exceed one of
+	// the limits in DecodeOptions
+	ErrLimitExceeded = errors.New("JPEG: limit exceeded")
+)
+
+// Phase is the phase of decoding or encoding in which an error happened.
+type Phase int
+
+const (
+	// PhaseHeader is reading JPEG header
+	PhaseHeader Phase = iota
+	// PhaseDecompress is decompressing image data
+	PhaseDecompress
+	// PhaseEncode is compressing an image
+	PhaseEncode
+)
+
+func (p Phase) String() string {
+	switch p {
+	case PhaseHeader:
+		return "header"
+	case PhaseDecompress:
+		return "decompress"
+	case PhaseEncode:
+		return "encode"
+	}
+	return "unknown"
+}
+
+// Error is an error reported by libjpeg. In strict mode (see DecodeOptions)
+// it can also be a warning. Code is libjpeg message code
+// (J_MESSAGE_CODE from jerror.h) and Msg is the formatted message.
+//
+// Use errors.Is with ErrNotJPEG, ErrTruncated, ErrUnsupportedColorSpace
+// or ErrInvalidDimensions to check for common classes of errors.
+type Error struct {
+	Code  int
+	Msg   string
+	Phase Phase
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("JPEG %s error: %s", e.Phase, e.Msg)
+}
+
+// errorClasses maps libjpeg message codes to sentinel errors
+var errorClasses = map[int]error{
+	C.JERR_NO_SOI:             ErrNotJPEG,
+	C.JERR_INPUT_EMPTY:        ErrNotJPEG,
+	C.JERR_INPUT_EOF:          ErrTruncated,
+	C.JERR_NO_IMAGE:           ErrTruncated,
+	C.JERR_SOF_NO_SOS:         ErrTruncated,
+	C.JWRN_JPEG_EOF:           ErrTruncated,
+	C.JERR_CONVERSION_NOTIMPL: ErrUnsupportedColorSpace,
+	C.JERR_BAD_J_COLORSPACE:   ErrUnsupportedColorSpace,
+	C.JERR_BAD_IN_COLORSPACE:  ErrUnsupportedColorSpace,
+	C.JERR_COMPONENT_COUNT:    ErrUnsupportedColorSpace,
+	C.JERR_IMAGE_TOO_BIG:      ErrInvalidDimensions,
+	C.JERR_EMPTY_IMAGE:        ErrInvalidDimensions,
+	C.JERR_WIDTH_OVERFLOW:     ErrInvalidDimensions,
+	C.JERR_NO_BACKING_STORE:   ErrLimitExceeded,
+	C.GOJERR_TOO_MANY_SCANS:   ErrLimitExceeded,
+}
+
+// Is reports whether e belongs to the class of errors described by target,
+// one of the sentinel errors.
+func (e *Error) Is(target error) bool {
+	class, ok := errorClasses[e.Code]
+	return ok && class == target
+}
+
+// Warning is a warning reported by libjpeg about a recoverable problem, like
+// corrupt or missing data. Code is libjpeg message code, like in Error.
+type Warning struct {
+	Code int
+	Msg  string
+}
+
+func (w Warning) String() string {
+	return w.Msg
+}
+
+func errorMgr(err *C.struct_jpeg_error_mgr) *C.go_error_mgr {
+	return (*C.go_error_mgr)(unsafe.Pointer(err))
+}
+
+// setStrict sets whether libjpeg warnings are errors
+func setStrict(err *C.struct_jpeg_error_mgr, strict bool) {
+	errorMgr(err).strict = 0
+	if strict {
+		errorMgr(err).strict = 1
+	}
+}
+
+// savedWarnings returns the warnings saved by the error manager
+func savedWarnings(err *C.struct_jpeg_error_mgr) []Warning {
+	e := errorMgr(err)
+	n := int(err.num_warnings)
+	if n > C.MAX_WARNINGS {
+		n = C.MAX_WARNINGS
+	}
+	var res []Warning
+	for i := 0; i < n; i++ {
+		res = append(res, Warning{
+			Code: int(e.warning_codes[i]),
+			Msg:  C.GoString(&e.warnings[i][0]),
+		})
+	}
+	return res
+}
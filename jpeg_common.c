@@ -1,17 +1,488 @@
 #include "_cgo_export.h"
+#include <jerror.h>
 
-void error_panic(j_common_ptr cinfo) {
-  struct { const char *p; } a;
-  char buffer[JMSG_LENGTH_MAX];
-  (*cinfo->err->format_message) (cinfo, buffer);
-  goPanic(buffer);
+// Go code can't be unwound by longjmp, so it must only be used to get out of
+// libjpeg's C frames. Go callbacks (goReaderFill, goWriterWrite, goProgress)
+// return an error code instead and C code calls ERREXIT after they return.
+static void error_longjmp(j_common_ptr cinfo) {
+  go_error_mgr *err = (go_error_mgr*) cinfo->err;
+  (*cinfo->err->format_message) (cinfo, err->msg);
+  longjmp(err->jmp, 1);
 }
 
+// is_data_warning returns 1 if warning code means that some image data is
+// missing or corrupt
+static int is_data_warning(int code) {
+  switch (code) {
+  case JWRN_JPEG_EOF:
+  case JWRN_HIT_MARKER:
+  case JWRN_MUST_RESYNC:
+  case JWRN_HUFF_BAD_CODE:
+  case JWRN_ARITH_BAD_CODE:
+  case JWRN_EXTRANEOUS_DATA:
+  case JWRN_BOGUS_PROGRESSION:
+  case JWRN_NOT_SEQUENTIAL:
+    return 1;
+  }
+  return 0;
+}
+
+static void emit_message_save(j_common_ptr cinfo, int msg_level) {
+  go_error_mgr *err = (go_error_mgr*) cinfo->err;
+  int code = err->pub.msg_code;
+  if (msg_level >= 0) {
+    // trace message
+    return;
+  }
+  if (err->strict) {
+    (*cinfo->err->error_exit) (cinfo);
+  }
+  if (code == JWRN_JPEG_EOF) {
+    err->truncated = 1;
+  }
+  if (cinfo->is_decompressor && err->bad_scanline < 0 && is_data_warning(code)) {
+    err->bad_scanline = ((j_decompress_ptr) cinfo)->output_scanline;
+  }
+  if (err->pub.num_warnings < MAX_WARNINGS) {
+    err->warning_codes[err->pub.num_warnings] = code;
+    (*cinfo->err->format_message) (cinfo, err->warnings[err->pub.num_warnings]);
+  }
+  err->pub.num_warnings++;
+}
+
+// reset_error_mgr is called by libjpeg when starting a new image
+static void reset_error_mgr(j_common_ptr cinfo) {
+  go_error_mgr *err = (go_error_mgr*) cinfo->err;
+  err->pub.num_warnings = 0;
+  err->pub.msg_code = 0;
+  err->bad_scanline = -1;
+  err->truncated = 0;
+}
+
+static const char * const addon_messages[] = {
+  NULL,
+  "Too many scans (%d), the limit is %d",
+  "Aborted",
+  NULL
+};
+
+struct jpeg_error_mgr *alloc_error_mgr(void) {
+  go_error_mgr *err = (go_error_mgr*) calloc(1, sizeof(go_error_mgr));
+  if (err == NULL) {
+    return NULL;
+  }
+  jpeg_std_error(&err->pub);
+  err->pub.error_exit = error_longjmp;
+  err->pub.emit_message = emit_message_save;
+  err->pub.reset_error_mgr = reset_error_mgr;
+  err->pub.addon_message_table = addon_messages;
+  err->pub.first_addon_message = GOJERR_FIRST_ADDON;
+  err->pub.last_addon_message = GOJERR_LAST_ADDON;
+  err->bad_scanline = -1;
+  return &err->pub;
+}
+
+const char *error_mgr_message(struct jpeg_error_mgr *err) {
+  return ((go_error_mgr*) err)->msg;
+}
+
+// TRY calls stmt, returning 0 if libjpeg error handler longjmps out of it
+#define TRY(cinfo, stmt) \
+  do { \
+    go_error_mgr *err_ = (go_error_mgr*) (cinfo)->err; \
+    if (setjmp(err_->jmp)) { \
+      return 0; \
+    } \
+    stmt; \
+    return 1; \
+  } while (0)
+
+int try_create_decompress(j_decompress_ptr cinfo) {
+  TRY(cinfo, jpeg_CreateDecompress(cinfo, JPEG_LIB_VERSION, sizeof(struct jpeg_decompress_struct)));
+}
+
+int try_read_header(j_decompress_ptr cinfo, int *res) {
+  TRY(cinfo, *res = jpeg_read_header(cinfo, TRUE));
+}
+
+int try_calc_output_dimensions(j_decompress_ptr cinfo) {
+  TRY(cinfo, jpeg_calc_output_dimensions(cinfo));
+}
+
+int try_start_decompress(j_decompress_ptr cinfo) {
+  TRY(cinfo, jpeg_start_decompress(cinfo));
+}
+
+// jpeg_read_scanlines() returns at most a row group (up to max_v_samp_factor
+// rows) at a time, so it's called in a loop to read all num_lines
+static void read_scanlines(j_decompress_ptr cinfo, JSAMPARRAY scanlines, JDIMENSION num_lines, JDIMENSION *n) {
+  JDIMENSION read;
+  *n = 0;
+  while (*n < num_lines) {
+    read = jpeg_read_scanlines(cinfo, scanlines + *n, num_lines - *n);
+    if (read == 0) {
+      // only happens with a suspending source manager
+      return;
+    }
+    *n += read;
+  }
+}
+
+int try_read_scanlines(j_decompress_ptr cinfo, JSAMPARRAY scanlines, JDIMENSION num_lines, JDIMENSION *n) {
+  TRY(cinfo, read_scanlines(cinfo, scanlines, num_lines, n));
+}
+
+int comp_h_scaled_size(jpeg_component_info *comp) {
+#if JPEG_LIB_VERSION >= 70
+  return comp->DCT_h_scaled_size;
+#else
+  return comp->DCT_scaled_size;
+#endif
+}
+
+int comp_v_scaled_size(jpeg_component_info *comp) {
+#if JPEG_LIB_VERSION >= 70
+  return comp->DCT_v_scaled_size;
+#else
+  return comp->DCT_scaled_size;
+#endif
+}
+
+int min_v_scaled_size(j_decompress_ptr cinfo) {
+#if JPEG_LIB_VERSION >= 70
+  return cinfo->min_DCT_v_scaled_size;
+#else
+  return cinfo->min_DCT_scaled_size;
+#endif
+}
+
+// read_raw_image reads the whole image with jpeg_read_raw_data() into
+// component planes, whose rows are strides[ci] bytes apart. Planes must have
+// room for whole iMCU rows, as libjpeg decodes whole blocks.
+static void read_raw_image(j_decompress_ptr cinfo, JSAMPLE **planes, const int *strides) {
+  // v_samp_factor is at most MAX_SAMP_FACTOR and scaled DCT size at most
+  // 2 * DCTSIZE (when scaling up)
+  JSAMPROW rows[MAX_COMPONENTS][MAX_SAMP_FACTOR * DCTSIZE * 2];
+  JSAMPARRAY image[MAX_COMPONENTS];
+  jpeg_component_info *comp;
+  JDIMENSION imcu;
+  int ci, r, n;
+  for (ci = 0; ci < cinfo->num_components; ci++) {
+    image[ci] = rows[ci];
+  }
+  for (imcu = 0; imcu < cinfo->total_iMCU_rows; imcu++) {
+    for (ci = 0; ci < cinfo->num_components; ci++) {
+      comp = &cinfo->comp_info[ci];
+      n = comp->v_samp_factor * comp_v_scaled_size(comp);
+      for (r = 0; r < n; r++) {
+        rows[ci][r] = planes[ci] + (size_t) (imcu * n + r) * strides[ci];
+      }
+    }
+    jpeg_read_raw_data(cinfo, image, cinfo->max_v_samp_factor * min_v_scaled_size(cinfo));
+  }
+}
+
+int try_read_raw_ycbcr(j_decompress_ptr cinfo, JSAMPLE *y, JSAMPLE *cb, JSAMPLE *cr, int y_stride, int c_stride) {
+  JSAMPLE *planes[3] = { y, cb, cr };
+  int strides[3] = { y_stride, c_stride, c_stride };
+  TRY(cinfo, read_raw_image(cinfo, planes, strides));
+}
+
+int try_skip_scanlines(j_decompress_ptr cinfo, JDIMENSION num_lines) {
+  TRY(cinfo, jpeg_skip_scanlines(cinfo, num_lines));
+}
+
+int try_crop_scanline(j_decompress_ptr cinfo, JDIMENSION *xoffset, JDIMENSION *width) {
+  TRY(cinfo, jpeg_crop_scanline(cinfo, xoffset, width));
+}
+
+int try_finish_decompress(j_decompress_ptr cinfo) {
+  TRY(cinfo, jpeg_finish_decompress(cinfo));
+}
+
+int try_mem_src(j_decompress_ptr cinfo, const unsigned char *buf, unsigned long size) {
+  TRY(cinfo, jpeg_mem_src(cinfo, buf, size));
+}
+
+int try_create_compress(j_compress_ptr cinfo) {
+  TRY(cinfo, jpeg_CreateCompress(cinfo, JPEG_LIB_VERSION, sizeof(struct jpeg_compress_struct)));
+}
+
+// standard Huffman tables, saved in cinfo->client_data
+typedef struct {
+  JHUFF_TBL dc[2];
+  JHUFF_TBL ac[2];
+} std_huff_tables;
+
+// jpeg_set_defaults() doesn't overwrite Huffman tables that already exist,
+// but optimized Huffman coding replaces them with the optimal tables of the
+// image. To reuse cinfo for more images, standard tables are saved the first
+// time and restored before jpeg_set_defaults().
+static void set_defaults(j_compress_ptr cinfo) {
+  std_huff_tables *std = (std_huff_tables*) cinfo->client_data;
+  int i;
+  if (std != NULL) {
+    for (i = 0; i < 2; i++) {
+      if (cinfo->dc_huff_tbl_ptrs[i] != NULL) {
+        *cinfo->dc_huff_tbl_ptrs[i] = std->dc[i];
+      }
+      if (cinfo->ac_huff_tbl_ptrs[i] != NULL) {
+        *cinfo->ac_huff_tbl_ptrs[i] = std->ac[i];
+      }
+    }
+  }
+  jpeg_set_defaults(cinfo);
+  if (std == NULL) {
+    std = (std_huff_tables*) (*cinfo->mem->alloc_small)
+      ((j_common_ptr) cinfo, JPOOL_PERMANENT, sizeof(std_huff_tables));
+    for (i = 0; i < 2; i++) {
+      std->dc[i] = *cinfo->dc_huff_tbl_ptrs[i];
+      std->ac[i] = *cinfo->ac_huff_tbl_ptrs[i];
+    }
+    cinfo->client_data = std;
+  }
+}
+
+int try_set_defaults(j_compress_ptr cinfo) {
+  TRY(cinfo, set_defaults(cinfo));
+}
+
+int try_set_colorspace(j_compress_ptr cinfo, J_COLOR_SPACE colorspace) {
+  TRY(cinfo, jpeg_set_colorspace(cinfo, colorspace));
+}
+
+int try_set_quality(j_compress_ptr cinfo, int quality, boolean force_baseline) {
+  TRY(cinfo, jpeg_set_quality(cinfo, quality, force_baseline));
+}
+
+int try_add_quant_table(j_compress_ptr cinfo, int which_tbl, const unsigned int *basic_table, int scale_factor, boolean force_baseline) {
+  TRY(cinfo, jpeg_add_quant_table(cinfo, which_tbl, basic_table, scale_factor, force_baseline));
+}
+
+int try_simple_progression(j_compress_ptr cinfo) {
+  TRY(cinfo, jpeg_simple_progression(cinfo));
+}
+
+// scans are allocated from the image pool, which is freed after compressing
+// the image, so they don't pile up when cinfo is reused
+int try_alloc_scan_info(j_compress_ptr cinfo, int n, jpeg_scan_info **scans) {
+  TRY(cinfo, *scans = (jpeg_scan_info*) (*cinfo->mem->alloc_small)
+    ((j_common_ptr) cinfo, JPOOL_IMAGE, n * sizeof(jpeg_scan_info)));
+}
+
+int try_start_compress(j_compress_ptr cinfo) {
+  TRY(cinfo, jpeg_start_compress(cinfo, TRUE));
+}
+
+int try_write_scanlines(j_compress_ptr cinfo, JSAMPARRAY scanlines, JDIMENSION num_lines) {
+  TRY(cinfo, jpeg_write_scanlines(cinfo, scanlines, num_lines));
+}
+
+// write_raw_imcu_row writes one iMCU row with jpeg_write_raw_data(). buf
+// holds v_samp_factor * DCTSIZE rows of width_in_blocks * DCTSIZE samples
+// of each component, one component after another.
+static void write_raw_imcu_row(j_compress_ptr cinfo, JSAMPLE *buf) {
+  JSAMPROW rows[MAX_COMPONENTS][MAX_SAMP_FACTOR * DCTSIZE];
+  JSAMPARRAY image[MAX_COMPONENTS];
+  jpeg_component_info *comp;
+  size_t width;
+  int ci, r;
+  for (ci = 0; ci < cinfo->num_components; ci++) {
+    comp = &cinfo->comp_info[ci];
+    width = (size_t) comp->width_in_blocks * DCTSIZE;
+    for (r = 0; r < comp->v_samp_factor * DCTSIZE; r++) {
+      rows[ci][r] = buf;
+      buf += width;
+    }
+    image[ci] = rows[ci];
+  }
+  jpeg_write_raw_data(cinfo, image, cinfo->max_v_samp_factor * DCTSIZE);
+}
+
+int try_write_raw_imcu_row(j_compress_ptr cinfo, JSAMPLE *buf) {
+  TRY(cinfo, write_raw_imcu_row(cinfo, buf));
+}
+
+int try_finish_compress(j_compress_ptr cinfo) {
+  TRY(cinfo, jpeg_finish_compress(cinfo));
+}
+
+// source manager that pulls compressed data from Go io.Reader, identified
+// by reader handle, via goReaderFill(). start_of_file is set until the first
+// data is read.
 typedef struct {
-  unsigned char *buf;
-  unsigned long buf_size;
-} mem_helper;
+  struct jpeg_source_mgr pub;
+  uintptr_t reader;
+  JOCTET *buf;
+  size_t buf_size;
+  boolean start_of_file;
+} reader_source_mgr;
+
+static void reader_init_source(j_decompress_ptr cinfo) {
+  reader_source_mgr *src = (reader_source_mgr*) cinfo->src;
+  src->start_of_file = TRUE;
+}
+
+static boolean reader_fill_input_buffer(j_decompress_ptr cinfo) {
+  reader_source_mgr *src = (reader_source_mgr*) cinfo->src;
+  long n = goReaderFill(src->reader, src->buf, src->buf_size);
+  if (n < 0) {
+    // the actual error is remembered on Go side
+    ERREXIT(cinfo, JERR_FILE_READ);
+  }
+  if (n == 0) {
+    if (src->start_of_file) {
+      // no data at all, the fake EOI would be reported as a bad SOI
+      ERREXIT(cinfo, JERR_INPUT_EMPTY);
+    }
+    // premature end of data: insert a fake EOI marker, like libjpeg's
+    // stdio source manager, so that we decode as much as we can
+    WARNMS(cinfo, JWRN_JPEG_EOF);
+    src->buf[0] = (JOCTET) 0xFF;
+    src->buf[1] = (JOCTET) JPEG_EOI;
+    n = 2;
+  }
+  src->pub.next_input_byte = src->buf;
+  src->pub.bytes_in_buffer = (size_t) n;
+  src->start_of_file = FALSE;
+  return TRUE;
+}
+
+static void reader_skip_input_data(j_decompress_ptr cinfo, long num_bytes) {
+  struct jpeg_source_mgr *src = cinfo->src;
+  if (num_bytes <= 0) {
+    return;
+  }
+  while (num_bytes > (long) src->bytes_in_buffer) {
+    num_bytes -= (long) src->bytes_in_buffer;
+    (void) (*src->fill_input_buffer) (cinfo);
+  }
+  src->next_input_byte += (size_t) num_bytes;
+  src->bytes_in_buffer -= (size_t) num_bytes;
+}
+
+static void reader_term_source(j_decompress_ptr cinfo) {
+}
+
+// buffers are allocated from libjpeg's permanent pool so they're freed by
+// jpeg_destroy_decompress()
+static void jpeg_reader_src(j_decompress_ptr cinfo, uintptr_t reader, size_t buf_size) {
+  reader_source_mgr *src = (reader_source_mgr*) (*cinfo->mem->alloc_small)
+    ((j_common_ptr) cinfo, JPOOL_PERMANENT, sizeof(reader_source_mgr));
+  src->buf = (JOCTET*) (*cinfo->mem->alloc_small)
+    ((j_common_ptr) cinfo, JPOOL_PERMANENT, buf_size);
+  src->buf_size = buf_size;
+  src->reader = reader;
+  src->pub.init_source = reader_init_source;
+  src->pub.fill_input_buffer = reader_fill_input_buffer;
+  src->pub.skip_input_data = reader_skip_input_data;
+  src->pub.resync_to_restart = jpeg_resync_to_restart;
+  src->pub.term_source = reader_term_source;
+  src->pub.bytes_in_buffer = 0;
+  src->pub.next_input_byte = NULL;
+  cinfo->src = (struct jpeg_source_mgr*) src;
+}
+
+int try_reader_src(j_decompress_ptr cinfo, uintptr_t reader, size_t buf_size) {
+  TRY(cinfo, jpeg_reader_src(cinfo, reader, buf_size));
+}
+
+// progress_monitor is called for every row of data libjpeg processes. While
+// the whole image is buffered (i.e. progressive and multi-scan images), it's
+// called for every row of input, so it catches too many scans before they're
+// processed.
+static void progress_monitor(j_common_ptr cinfo) {
+  go_progress_mgr *progress = (go_progress_mgr*) cinfo->progress;
+  if (cinfo->is_decompressor && progress->max_scans > 0) {
+    j_decompress_ptr dinfo = (j_decompress_ptr) cinfo;
+    if (dinfo->input_scan_number > progress->max_scans) {
+      ERREXIT2(cinfo, GOJERR_TOO_MANY_SCANS, dinfo->input_scan_number, progress->max_scans);
+    }
+  }
+  if (progress->monitor != 0 && goProgress(progress->monitor, &progress->pub) != 0) {
+    // the actual error is remembered on Go side
+    ERREXIT(cinfo, GOJERR_ABORTED);
+  }
+}
+
+// it's allocated from libjpeg's permanent pool so it's freed by
+// jpeg_destroy(). It's only installed once.
+static void jpeg_progress_mgr(j_common_ptr cinfo) {
+  go_progress_mgr *progress;
+  if (cinfo->progress != NULL) {
+    return;
+  }
+  progress = (go_progress_mgr*) (*cinfo->mem->alloc_small)
+    (cinfo, JPOOL_PERMANENT, sizeof(go_progress_mgr));
+  memset(progress, 0, sizeof(go_progress_mgr));
+  progress->pub.progress_monitor = progress_monitor;
+  cinfo->progress = &progress->pub;
+}
+
+int try_progress_mgr(j_common_ptr cinfo) {
+  TRY(cinfo, jpeg_progress_mgr(cinfo));
+}
+
+// destination manager that pushes compressed data to Go io.Writer, identified
+// by writer handle, via goWriterWrite()
+typedef struct {
+  struct jpeg_destination_mgr pub;
+  uintptr_t writer;
+  JOCTET *buf;
+  size_t buf_size;
+} writer_dest_mgr;
+
+static void writer_init_destination(j_compress_ptr cinfo) {
+  writer_dest_mgr *dest = (writer_dest_mgr*) cinfo->dest;
+  dest->pub.next_output_byte = dest->buf;
+  dest->pub.free_in_buffer = dest->buf_size;
+}
+
+static boolean writer_empty_output_buffer(j_compress_ptr cinfo) {
+  writer_dest_mgr *dest = (writer_dest_mgr*) cinfo->dest;
+  // per libjpeg docs, the whole buffer is flushed, ignoring free_in_buffer
+  if (goWriterWrite(dest->writer, dest->buf, dest->buf_size) != 0) {
+    // the actual error is remembered on Go side
+    ERREXIT(cinfo, JERR_FILE_WRITE);
+  }
+  dest->pub.next_output_byte = dest->buf;
+  dest->pub.free_in_buffer = dest->buf_size;
+  return TRUE;
+}
+
+static void writer_term_destination(j_compress_ptr cinfo) {
+  writer_dest_mgr *dest = (writer_dest_mgr*) cinfo->dest;
+  size_t n = dest->buf_size - dest->pub.free_in_buffer;
+  if (n > 0 && goWriterWrite(dest->writer, dest->buf, n) != 0) {
+    ERREXIT(cinfo, JERR_FILE_WRITE);
+  }
+}
+
+// buffers are allocated from libjpeg's permanent pool so they're freed by
+// jpeg_destroy_compress(). When compressing more images with the same cinfo,
+// they're allocated only once.
+static void jpeg_writer_dest(j_compress_ptr cinfo, uintptr_t writer, size_t buf_size) {
+  writer_dest_mgr *dest = (writer_dest_mgr*) cinfo->dest;
+  if (dest != NULL) {
+    if (dest->pub.init_destination != writer_init_destination || dest->buf_size != buf_size) {
+      // like jpeg_mem_dest(), can't mix destination managers
+      ERREXIT(cinfo, JERR_BUFFER_SIZE);
+    }
+    dest->writer = writer;
+    return;
+  }
+  dest = (writer_dest_mgr*) (*cinfo->mem->alloc_small)
+    ((j_common_ptr) cinfo, JPOOL_PERMANENT, sizeof(writer_dest_mgr));
+  dest->buf = (JOCTET*) (*cinfo->mem->alloc_small)
+    ((j_common_ptr) cinfo, JPOOL_PERMANENT, buf_size);
+  dest->buf_size = buf_size;
+  dest->writer = writer;
+  dest->pub.init_destination = writer_init_destination;
+  dest->pub.empty_output_buffer = writer_empty_output_buffer;
+  dest->pub.term_destination = writer_term_destination;
+  cinfo->dest = (struct jpeg_destination_mgr*) dest;
+}
 
-mem_helper *alloc_mem_helper() {
-  return (mem_helper*) calloc(1,sizeof(mem_helper));
+int try_writer_dest(j_compress_ptr cinfo, uintptr_t writer, size_t buf_size) {
+  TRY(cinfo, jpeg_writer_dest(cinfo, writer, buf_size));
 }
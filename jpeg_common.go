@@ -3,15 +3,115 @@ package golibjpegturbo
 /*
 #cgo LDFLAGS: -ljpeg
 
-#include <stdlib.h>
-#include <stdio.h>
-#include <jpeglib.h>
-
-void goPanic(char *);
+#include "jpeg_common.h"
 */
 import "C"
 
-//export goPanic
-func goPanic(msg *C.char) {
-	panic(C.GoString(msg))
+import (
+	"io"
+	"runtime/cgo"
+	"unsafe"
+)
+
+// readerSource is the Go side of reader source manager (see jpeg_reader_src
+// in jpeg_common.c). err is the error returned by r that made decoding fail.
+type readerSource struct {
+	r   io.Reader
+	err error
+}
+
+// lineBuffer is C memory for scanlines. It's kept between calls by Decoder
+// and Encoder.
+type lineBuffer struct {
+	p    unsafe.Pointer
+	size int
+}
+
+// get returns the buffer, growing it to at least size bytes
+func (b *lineBuffer) get(size int) unsafe.Pointer {
+	if b.size < size {
+		C.free(b.p)
+		b.p = C.malloc(C.size_t(size))
+		b.size = size
+	}
+	return b.p
+}
+
+func (b *lineBuffer) free() {
+	C.free(b.p)
+	b.p = nil
+	b.size = 0
+}
+
+// writerDest is the Go side of writer destination manager (see
+// jpeg_writer_dest in jpeg_common.c). err is the error returned by w that
+// made encoding fail.
+type writerDest struct {
+	w   io.Writer
+	err error
+}
+
+// maxEmptyReads is the number of reads returning no data and no error after
+// which goReaderFill gives up, like bufio.Reader
+const maxEmptyReads = 100
+
+// goReaderFill is called by reader source manager to read up to size bytes
+// into buf from readerSource identified by handle h. It returns number of
+// bytes read, 0 meaning end of data and -1 meaning error.
+//
+//export goReaderFill
+func goReaderFill(h C.uintptr_t, buf *C.uchar, size C.size_t) C.long {
+	src := cgo.Handle(h).Value().(*readerSource)
+	// buf is C memory, so the reader can write into it directly
+	d := sliceFromCBytes(unsafe.Pointer(buf), int(size))
+	if src.err != nil {
+		// error returned along with data by the previous read
+		return -1
+	}
+	for i := 0; i < maxEmptyReads; i++ {
+		n, err := src.r.Read(d)
+		if err != nil && err != io.EOF {
+			// remembered even if libjpeg doesn't need more data, so that
+			// decoding fails
+			src.err = err
+		}
+		if n > 0 {
+			return C.long(n)
+		}
+		if err == io.EOF {
+			return 0
+		}
+		if err != nil {
+			return -1
+		}
+	}
+	src.err = io.ErrNoProgress
+	return -1
+}
+
+// goWriterWrite is called by writer destination manager to write size bytes
+// from buf to writerDest identified by handle h. It returns 0 on success and
+// -1 on error.
+//
+//export goWriterWrite
+func goWriterWrite(h C.uintptr_t, buf *C.uchar, size C.size_t) C.int {
+	dest := cgo.Handle(h).Value().(*writerDest)
+	// buf is C memory so it's safe to pass to w without copying, io.Writer
+	// must not retain it
+	_, err := dest.w.Write(sliceFromCBytes(unsafe.Pointer(buf), int(size)))
+	if err != nil {
+		dest.err = err
+		return -1
+	}
+	return 0
+}
+
+// jpegError returns the error with which libjpeg failed inside a try_*
+// function
+func jpegError(err *C.struct_jpeg_error_mgr, phase Phase) error {
+	return &Error{
+		Code:  int(err.msg_code),
+		Msg:   C.GoString(C.error_mgr_message(err)),
+		Phase: phase,
+	}
 }
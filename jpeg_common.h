@@ -0,0 +1,86 @@
+#ifndef JPEG_COMMON_H
+#define JPEG_COMMON_H
+
+#include <stddef.h>
+#include <stdint.h>
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <setjmp.h>
+#include <jpeglib.h>
+
+// maximum number of warning messages saved by go_error_mgr
+#define MAX_WARNINGS 16
+
+// error manager that longjmps back to try_* function that called into
+// libjpeg instead of calling exit(). The message is saved in msg.
+//
+// Warnings are saved instead of being printed to stderr, or turned into
+// errors if strict is set. pub.num_warnings is the number of all warnings,
+// only the first MAX_WARNINGS are saved. bad_scanline is the output scanline
+// at which the first warning about missing or corrupt data happened, or -1.
+typedef struct {
+  struct jpeg_error_mgr pub;
+  jmp_buf jmp;
+  char msg[JMSG_LENGTH_MAX];
+  int strict;
+  int warning_codes[MAX_WARNINGS];
+  char warnings[MAX_WARNINGS][JMSG_LENGTH_MAX];
+  long bad_scanline;
+  int truncated;
+} go_error_mgr;
+
+// codes of messages added to libjpeg's messages, see addon_message_table
+enum {
+  GOJERR_FIRST_ADDON = 1000,
+  GOJERR_TOO_MANY_SCANS,
+  GOJERR_ABORTED,
+  GOJERR_LAST_ADDON
+};
+
+// progress manager that enforces limits libjpeg doesn't have itself and
+// reports progress to Go. monitor is a handle to Go progressMonitor or 0.
+typedef struct {
+  struct jpeg_progress_mgr pub;
+  int max_scans;
+  uintptr_t monitor;
+} go_progress_mgr;
+
+struct jpeg_error_mgr *alloc_error_mgr(void);
+const char *error_mgr_message(struct jpeg_error_mgr *err);
+
+// scaled DCT block sizes, which are named differently in libjpeg 7+ API
+int comp_h_scaled_size(jpeg_component_info *comp);
+int comp_v_scaled_size(jpeg_component_info *comp);
+int min_v_scaled_size(j_decompress_ptr cinfo);
+
+// try_* functions call the corresponding libjpeg function and return 1 on
+// success or 0 if libjpeg failed with an error
+int try_progress_mgr(j_common_ptr cinfo);
+
+int try_create_decompress(j_decompress_ptr cinfo);
+int try_read_header(j_decompress_ptr cinfo, int *res);
+int try_calc_output_dimensions(j_decompress_ptr cinfo);
+int try_start_decompress(j_decompress_ptr cinfo);
+int try_read_scanlines(j_decompress_ptr cinfo, JSAMPARRAY scanlines, JDIMENSION num_lines, JDIMENSION *n);
+int try_read_raw_ycbcr(j_decompress_ptr cinfo, JSAMPLE *y, JSAMPLE *cb, JSAMPLE *cr, int y_stride, int c_stride);
+int try_skip_scanlines(j_decompress_ptr cinfo, JDIMENSION num_lines);
+int try_crop_scanline(j_decompress_ptr cinfo, JDIMENSION *xoffset, JDIMENSION *width);
+int try_finish_decompress(j_decompress_ptr cinfo);
+int try_mem_src(j_decompress_ptr cinfo, const unsigned char *buf, unsigned long size);
+int try_reader_src(j_decompress_ptr cinfo, uintptr_t reader, size_t buf_size);
+
+int try_create_compress(j_compress_ptr cinfo);
+int try_set_defaults(j_compress_ptr cinfo);
+int try_set_colorspace(j_compress_ptr cinfo, J_COLOR_SPACE colorspace);
+int try_set_quality(j_compress_ptr cinfo, int quality, boolean force_baseline);
+int try_add_quant_table(j_compress_ptr cinfo, int which_tbl, const unsigned int *basic_table, int scale_factor, boolean force_baseline);
+int try_simple_progression(j_compress_ptr cinfo);
+int try_alloc_scan_info(j_compress_ptr cinfo, int n, jpeg_scan_info **scans);
+int try_start_compress(j_compress_ptr cinfo);
+int try_write_scanlines(j_compress_ptr cinfo, JSAMPARRAY scanlines, JDIMENSION num_lines);
+int try_write_raw_imcu_row(j_compress_ptr cinfo, JSAMPLE *buf);
+int try_finish_compress(j_compress_ptr cinfo);
+int try_writer_dest(j_compress_ptr cinfo, uintptr_t writer, size_t buf_size);
+
+#endif
@@ -0,0 +1,226 @@
+package golibjpegturbo
+
+/*
+#include "jpeg_common.h"
+*/
+import "C"
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+)
+
+// PixelFormat is the pixel format of decoded images (see DecodeOptions).
+//
+// Formats with an image.Image type in the standard library are decoded as
+// that type, others as *RawImage. Decoded pixels are always opaque, so
+// alpha (A) and padding (X) bytes are 0xff.
+type PixelFormat int
+
+const (
+	// PixelFormatDefault decodes grayscale images as *image.Gray and
+	// color images as *image.RGBA
+	PixelFormatDefault PixelFormat = iota
+	// PixelFormatRGBA decodes as *image.RGBA
+	PixelFormatRGBA
+	// PixelFormatNRGBA decodes as *image.NRGBA
+	PixelFormatNRGBA
+	// PixelFormatGray decodes as *image.Gray, color images are converted
+	// to grayscale
+	PixelFormatGray
+	// PixelFormatRGB and the rest decode as *RawImage with bytes of each
+	// pixel in the order given by the name
+	PixelFormatRGB
+	PixelFormatBGR
+	PixelFormatRGBX
+	PixelFormatBGRX
+	PixelFormatXRGB
+	PixelFormatXBGR
+	PixelFormatBGRA
+	PixelFormatARGB
+	PixelFormatABGR
+	// PixelFormatCMYK decodes as *image.CMYK. CMYK and YCCK images are
+	// decoded without conversion to RGB, except that 'Inverted CMYK' (see
+	// JpegInfo) is inverted back, other images are converted.
+	PixelFormatCMYK
+)
+
+// pixelFormats are libjpeg output color spaces and the order of components
+// within a pixel for each PixelFormat. L is luma.
+var pixelFormats = [...]struct {
+	name       string
+	colorSpace C.J_COLOR_SPACE
+	order      string
+}{
+	PixelFormatDefault: {"Default", C.JCS_UNKNOWN, ""},
+	PixelFormatRGBA:    {"RGBA", C.JCS_EXT_RGBA, "RGBA"},
+	PixelFormatNRGBA:   {"NRGBA", C.JCS_EXT_RGBA, "RGBA"},
+	PixelFormatGray:    {"Gray", C.JCS_GRAYSCALE, "L"},
+	PixelFormatRGB:     {"RGB", C.JCS_EXT_RGB, "RGB"},
+	PixelFormatBGR:     {"BGR", C.JCS_EXT_BGR, "BGR"},
+	PixelFormatRGBX:    {"RGBX", C.JCS_EXT_RGBX, "RGBX"},
+	PixelFormatBGRX:    {"BGRX", C.JCS_EXT_BGRX, "BGRX"},
+	PixelFormatXRGB:    {"XRGB", C.JCS_EXT_XRGB, "XRGB"},
+	PixelFormatXBGR:    {"XBGR", C.JCS_EXT_XBGR, "XBGR"},
+	PixelFormatBGRA:    {"BGRA", C.JCS_EXT_BGRA, "BGRA"},
+	PixelFormatARGB:    {"ARGB", C.JCS_EXT_ARGB, "ARGB"},
+	PixelFormatABGR:    {"ABGR", C.JCS_EXT_ABGR, "ABGR"},
+	PixelFormatCMYK:    {"CMYK", C.JCS_CMYK, "CMYK"},
+}
+
+func (f PixelFormat) String() string {
+	if f < 0 || int(f) >= len(pixelFormats) {
+		return fmt.Sprintf("PixelFormat(%d)", int(f))
+	}
+	return pixelFormats[f].name
+}
+
+// BytesPerPixel returns the size of a pixel in bytes. It's 0 for
+// PixelFormatDefault and invalid formats.
+func (f PixelFormat) BytesPerPixel() int {
+	if f < 0 || int(f) >= len(pixelFormats) {
+		return 0
+	}
+	return len(pixelFormats[f].order)
+}
+
+func (f PixelFormat) validate() error {
+	if f < PixelFormatDefault || f > PixelFormatCMYK {
+		return fmt.Errorf("invalid pixel format %d", f)
+	}
+	return nil
+}
+
+// RawImage is a decoded image in a PixelFormat that has no image.Image
+// type in the standard library. Rows of pixels are Stride bytes apart and
+// the pixel at (x, y) starts at Pix[PixOffset(x, y)].
+type RawImage struct {
+	Pix    []byte
+	Stride int
+	Rect   image.Rectangle
+	Format PixelFormat
+}
+
+// NewRawImage returns a new RawImage with format f and bounds r.
+func NewRawImage(r image.Rectangle, f PixelFormat) *RawImage {
+	stride := r.Dx() * f.BytesPerPixel()
+	return &RawImage{
+		Pix:    make([]byte, stride*r.Dy()),
+		Stride: stride,
+		Rect:   r,
+		Format: f,
+	}
+}
+
+func (p *RawImage) ColorModel() color.Model {
+	return color.RGBAModel
+}
+
+func (p *RawImage) Bounds() image.Rectangle {
+	return p.Rect
+}
+
+func (p *RawImage) At(x, y int) color.Color {
+	if !image.Pt(x, y).In(p.Rect) {
+		return color.RGBA{}
+	}
+	c := color.RGBA{A: 0xff}
+	pix := p.Pix[p.PixOffset(x, y):]
+	for i, ch := range pixelFormats[p.Format].order {
+		switch ch {
+		case 'R':
+			c.R = pix[i]
+		case 'G':
+			c.G = pix[i]
+		case 'B':
+			c.B = pix[i]
+		case 'A':
+			c.A = pix[i]
+		}
+	}
+	return c
+}
+
+// PixOffset returns the index of the first byte of pixel at (x, y) in Pix.
+func (p *RawImage) PixOffset(x, y int) int {
+	return (y-p.Rect.Min.Y)*p.Stride + (x-p.Rect.Min.X)*p.Format.BytesPerPixel()
+}
+
+// SubImage returns an image representing the portion of the image p
+// visible through r. The returned value shares pixels with the original.
+func (p *RawImage) SubImage(r image.Rectangle) image.Image {
+	r = r.Intersect(p.Rect)
+	if r.Empty() {
+		return &RawImage{Format: p.Format}
+	}
+	i := p.PixOffset(r.Min.X, r.Min.Y)
+	return &RawImage{
+		Pix:    p.Pix[i:],
+		Stride: p.Stride,
+		Rect:   r,
+		Format: p.Format,
+	}
+}
+
+// newDecodedImage returns an image with bounds r for pixels decoded by
+// libjpeg in format f (that's not PixelFormatDefault) and its pixels
+func newDecodedImage(f PixelFormat, r image.Rectangle) (image.Image, []byte, int) {
+	switch f {
+	case PixelFormatRGBA:
+		img := image.NewRGBA(r)
+		return img, img.Pix, img.Stride
+	case PixelFormatNRGBA:
+		img := image.NewNRGBA(r)
+		return img, img.Pix, img.Stride
+	case PixelFormatGray:
+		img := image.NewGray(r)
+		return img, img.Pix, img.Stride
+	case PixelFormatCMYK:
+		img := image.NewCMYK(r)
+		return img, img.Pix, img.Stride
+	}
+	img := NewRawImage(r, f)
+	return img, img.Pix, img.Stride
+}
+
+// convertRGBA converts RGBA pixels of m to format f. It's used for CMYK
+// images, which libjpeg can't convert to anything but CMYK, and for
+// converting to CMYK.
+func convertRGBA(m *image.RGBA, f PixelFormat) image.Image {
+	img, pix, stride := newDecodedImage(f, m.Rect)
+	order := pixelFormats[f].order
+	dx, dy := m.Rect.Dx(), m.Rect.Dy()
+	for y := 0; y < dy; y++ {
+		src := m.Pix[y*m.Stride : y*m.Stride+dx*4]
+		dst := pix[y*stride : y*stride+dx*len(order)]
+		for x := 0; x < dx; x++ {
+			s := src[x*4 : x*4+4]
+			d := dst[x*len(order):]
+			for i, ch := range order {
+				switch ch {
+				case 'R':
+					d[i] = s[0]
+				case 'G':
+					d[i] = s[1]
+				case 'B':
+					d[i] = s[2]
+				case 'L':
+					d[i] = rgbToGray(s[0], s[1], s[2])
+				case 'C', 'M', 'Y', 'K':
+					if ch == 'C' {
+						d[0], d[1], d[2], d[3] = color.RGBToCMYK(s[0], s[1], s[2])
+					}
+				default:
+					d[i] = 0xff
+				}
+			}
+		}
+	}
+	return img
+}
+
+// rgbToGray returns luma of RGB color, same as color.GrayModel
+func rgbToGray(r, g, b uint8) uint8 {
+	return uint8((19595*uint32(r) + 38470*uint32(g) + 7471*uint32(b) + 1<<15) >> 16)
+}
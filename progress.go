@@ -0,0 +1,90 @@
+package golibjpegturbo
+
+/*
+#include "jpeg_common.h"
+*/
+import "C"
+
+import (
+	"context"
+	"runtime/cgo"
+	"unsafe"
+)
+
+// Progress is the progress of decoding or encoding reported by libjpeg.
+//
+// libjpeg processes the image in one or more passes, TotalPasses is only
+// an estimate and can change as decoding progresses (e.g. when a
+// progressive image has more scans than expected). Pass is the number of
+// completed passes. Completed out of Total units (usually scanlines or
+// rows of blocks) of the current pass are done.
+type Progress struct {
+	Pass        int
+	TotalPasses int
+	Completed   int
+	Total       int
+}
+
+// progressMonitor is the Go side of progress manager (see progress_monitor
+// in jpeg_common.c). err is ctx.Err() that made decoding or encoding fail.
+type progressMonitor struct {
+	ctx      context.Context
+	fn       func(Progress)
+	err      error
+	h        cgo.Handle
+	progress *C.go_progress_mgr
+}
+
+// progressMgr returns the progress manager of cinfo, installing it if
+// it's not installed yet
+func progressMgr(cinfo C.j_common_ptr, phase Phase) (*C.go_progress_mgr, error) {
+	if C.try_progress_mgr(cinfo) == 0 {
+		return nil, jpegError(cinfo.err, phase)
+	}
+	return (*C.go_progress_mgr)(unsafe.Pointer(cinfo.progress)), nil
+}
+
+// watchProgress makes libjpeg report progress to fn and abort when ctx is
+// done. It returns nil if there's nothing to watch, otherwise the monitor
+// must be released after libjpeg is done.
+func watchProgress(cinfo C.j_common_ptr, ctx context.Context, fn func(Progress), phase Phase) (*progressMonitor, error) {
+	if ctx.Done() == nil && fn == nil {
+		return nil, nil
+	}
+	progress, err := progressMgr(cinfo, phase)
+	if err != nil {
+		return nil, err
+	}
+	// C code can't hold a Go pointer so it only gets a handle to m
+	m := &progressMonitor{ctx: ctx, fn: fn, progress: progress}
+	m.h = cgo.NewHandle(m)
+	progress.monitor = C.uintptr_t(m.h)
+	return m, nil
+}
+
+func (m *progressMonitor) release() {
+	m.progress.monitor = 0
+	m.h.Delete()
+}
+
+// goProgress is called by progress manager to report progress p to
+// progressMonitor identified by handle h. It returns 0 to continue or -1
+// once ctx is done, which makes libjpeg fail with GOJERR_ABORTED.
+//
+//export goProgress
+func goProgress(h C.uintptr_t, p *C.struct_jpeg_progress_mgr) C.int {
+	m := cgo.Handle(h).Value().(*progressMonitor)
+	if m.fn != nil {
+		m.fn(Progress{
+			Pass:        int(p.completed_passes),
+			TotalPasses: int(p.total_passes),
+			Completed:   int(p.pass_counter),
+			Total:       int(p.pass_limit),
+		})
+	}
+	if err := m.ctx.Err(); err != nil {
+		m.err = err
+		return -1
+	}
+	return 0
+}
@@ -0,0 +1,291 @@
+package golibjpegturbo
+
+/*
+#include "jpeg_common.h"
+*/
+import "C"
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+// QuantTable is an 8x8 quantization table in natural (row-major) order,
+// not in zig-zag order in which it's stored in JPEG file.
+//
+// When encoding, Options.QuantTables are basic tables, scaled for quality
+// just like libjpeg scales the standard tables from JPEG spec (see
+// StdLumaQuantTable and StdChromaQuantTable). Table 0 is scaled according to
+// Options.LumaQuality and other tables according to Options.ChromaQuality.
+// Either defaults to Options.Quality if 0. Quality of 50 uses the tables as
+// they are.
+//
+// By default components use the same table numbers as with standard tables
+// i.e. for YCbCr table 0 for luma and table 1 for chroma, clamped to the
+// number of tables. Options.QuantTableIndex[i], if present, is the table
+// used by component i.
+type QuantTable [64]uint16
+
+// StdLumaQuantTable is the luminance quantization table from JPEG spec
+// (Annex K), used by libjpeg by default.
+var StdLumaQuantTable = QuantTable{
+	16, 11, 10, 16, 24, 40, 51, 61,
+	12, 12, 14, 19, 26, 58, 60, 55,
+	14, 13, 16, 24, 40, 57, 69, 56,
+	14, 17, 22, 29, 51, 87, 80, 62,
+	18, 22, 37, 56, 68, 109, 103, 77,
+	24, 35, 55, 64, 81, 104, 113, 92,
+	49, 64, 78, 87, 103, 121, 120, 101,
+	72, 92, 95, 98, 112, 100, 103, 99,
+}
+
+// StdChromaQuantTable is the chrominance quantization table from JPEG spec
+// (Annex K), used by libjpeg by default.
+var StdChromaQuantTable = QuantTable{
+	17, 18, 24, 47, 99, 99, 99, 99,
+	18, 21, 26, 66, 99, 99, 99, 99,
+	24, 26, 56, 99, 99, 99, 99, 99,
+	47, 66, 99, 99, 99, 99, 99, 99,
+	99, 99, 99, 99, 99, 99, 99, 99,
+	99, 99, 99, 99, 99, 99, 99, 99,
+	99, 99, 99, 99, 99, 99, 99, 99,
+	99, 99, 99, 99, 99, 99, 99, 99,
+}
+
+// maxQuantTables is the maximum number of quantization tables in JPEG image
+const maxQuantTables = C.NUM_QUANT_TBLS
+
+// HuffmanTable is a Huffman table, as stored in DHT marker.
+// Class is 0 for DC tables and 1 for AC tables, Index is table number (0-3).
+// Bits[i] is the number of codes of length i+1 and Values are the symbols
+// in order of increasing code length.
+type HuffmanTable struct {
+	Class  int
+	Index  int
+	Bits   [16]uint8
+	Values []uint8
+}
+
+// usesCustomQuant returns true if o asks for something else than standard
+// tables scaled by jpeg_set_quality()
+func (o *Options) usesCustomQuant() bool {
+	return o.SourceInfo != nil || len(o.QuantTables) > 0 || len(o.QuantTableIndex) > 0 || o.LumaQuality > 0 || o.ChromaQuality > 0
+}
+
+// quantTables returns tables that will be installed, standard tables if
+// QuantTables is empty
+func (o *Options) quantTables() []QuantTable {
+	if o.SourceInfo != nil {
+		return o.SourceInfo.QuantTables
+	}
+	if len(o.QuantTables) > 0 {
+		return o.QuantTables
+	}
+	return []QuantTable{StdLumaQuantTable, StdChromaQuantTable}
+}
+
+// quantTableIndex returns tables used by components
+func (o *Options) quantTableIndex() []int {
+	if o.SourceInfo != nil {
+		return o.SourceInfo.QuantTableIndex
+	}
+	return o.QuantTableIndex
+}
+
+func (o *Options) validateQuant() error {
+	if o.SourceInfo != nil {
+		if len(o.SourceInfo.QuantTables) == 0 || len(o.SourceInfo.QuantTables) > maxQuantTables {
+			return fmt.Errorf("invalid number of quantization tables in SourceInfo (%d)", len(o.SourceInfo.QuantTables))
+		}
+	}
+	if o.LumaQuality < 0 || o.LumaQuality > 100 {
+		return fmt.Errorf("invalid luma quality %d (must be 0 to 100)", o.LumaQuality)
+	}
+	if o.ChromaQuality < 0 || o.ChromaQuality > 100 {
+		return fmt.Errorf("invalid chroma quality %d (must be 0 to 100)", o.ChromaQuality)
+	}
+	if len(o.QuantTables) > maxQuantTables {
+		return fmt.Errorf("too many quantization tables (%d, max is %d)", len(o.QuantTables), maxQuantTables)
+	}
+	for i, t := range o.quantTables() {
+		for j, v := range t {
+			if v == 0 || v > 32767 {
+				return fmt.Errorf("invalid value %d at %d in quantization table %d (must be 1 to 32767)", v, j, i)
+			}
+		}
+	}
+	n := len(o.quantTables())
+	for i, idx := range o.quantTableIndex() {
+		if idx < 0 || idx >= n {
+			return fmt.Errorf("invalid quantization table %d for component %d (must be 0 to %d)", idx, i, n-1)
+		}
+	}
+	return nil
+}
+
+// addQuantTable installs basic table t as table number which, scaled for
+// quality
+func addQuantTable(cinfo *C.struct_jpeg_compress_struct, which int, t *QuantTable, quality int, forceBaseline bool) error {
+	var basic [64]C.uint
+	for i, v := range t {
+		basic[i] = C.uint(v)
+	}
+	scale := C.jpeg_quality_scaling(C.int(quality))
+	if C.try_add_quant_table(cinfo, C.int(which), &basic[0], scale, cBool(forceBaseline)) == 0 {
+		return jpegError(cinfo.err, PhaseEncode)
+	}
+	return nil
+}
+
+// applyQuantOptions installs custom quantization tables and assigns them to
+// components. It must be called after color space is set.
+func applyQuantOptions(cinfo *C.struct_jpeg_compress_struct, o *Options) error {
+	if !o.usesCustomQuant() {
+		return nil
+	}
+	quality := o.Quality
+	if quality == 0 {
+		quality = DefaultQuality
+	}
+	lumaQuality, chromaQuality := quality, quality
+	if o.LumaQuality > 0 {
+		lumaQuality = o.LumaQuality
+	}
+	if o.ChromaQuality > 0 {
+		chromaQuality = o.ChromaQuality
+	}
+	if o.SourceInfo != nil {
+		// quality 50 means tables are used as they are
+		lumaQuality, chromaQuality = 50, 50
+	}
+	tables := o.quantTables()
+	index := o.quantTableIndex()
+	for i := range tables {
+		q := chromaQuality
+		if i == 0 {
+			q = lumaQuality
+		}
+		if err := addQuantTable(cinfo, i, &tables[i], q, !o.AllowExtendedQuant); err != nil {
+			return err
+		}
+	}
+	comps := compInfo(cinfo)
+	for i := range comps {
+		if i < len(index) {
+			comps[i].quant_tbl_no = C.int(index[i])
+		} else if int(comps[i].quant_tbl_no) >= len(tables) {
+			comps[i].quant_tbl_no = C.int(len(tables) - 1)
+		}
+	}
+	return nil
+}
+
+// readQuantTables returns quantization tables defined in the header of
+// JPEG image and the index of the table used by each component
+func readQuantTables(cinfo *C.struct_jpeg_decompress_struct) ([]QuantTable, []int) {
+	var tables []QuantTable
+	// tables might not be numbered contiguously, we compact them
+	var tableIndex [maxQuantTables]int
+	for i, p := range cinfo.quant_tbl_ptrs {
+		if p == nil {
+			continue
+		}
+		var t QuantTable
+		for j, v := range p.quantval {
+			t[j] = uint16(v)
+		}
+		tableIndex[i] = len(tables)
+		tables = append(tables, t)
+	}
+	comps := unsafe.Slice(cinfo.comp_info, int(cinfo.num_components))
+	index := make([]int, len(comps))
+	for i, comp := range comps {
+		index[i] = tableIndex[comp.quant_tbl_no]
+	}
+	return tables, index
+}
+
+// readHuffmanTables returns Huffman tables defined in the header of JPEG image
+func readHuffmanTables(cinfo *C.struct_jpeg_decompress_struct) []HuffmanTable {
+	var res []HuffmanTable
+	for class, ptrs := range [][C.NUM_HUFF_TBLS]*C.JHUFF_TBL{cinfo.dc_huff_tbl_ptrs, cinfo.ac_huff_tbl_ptrs} {
+		for i, p := range ptrs {
+			if p == nil {
+				continue
+			}
+			t := HuffmanTable{Class: class, Index: i}
+			n := 0
+			for j := range t.Bits {
+				t.Bits[j] = uint8(p.bits[j+1])
+				n += int(t.Bits[j])
+			}
+			if n > len(p.huffval) {
+				n = len(p.huffval)
+			}
+			t.Values = make([]uint8, n)
+			for j := range t.Values {
+				t.Values[j] = uint8(p.huffval[j])
+			}
+			res = append(res, t)
+		}
+	}
+	return res
+}
+
+// scaleQuantTable scales basic table t for quality like
+// jpeg_add_quant_table() does, without forcing baseline
+func scaleQuantTable(t *QuantTable, quality int) QuantTable {
+	scale := int(C.jpeg_quality_scaling(C.int(quality)))
+	var res QuantTable
+	for i, v := range t {
+		temp := (int(v)*scale + 50) / 100
+		if temp <= 0 {
+			temp = 1
+		}
+		if temp > 32767 {
+			temp = 32767
+		}
+		res[i] = uint16(temp)
+	}
+	return res
+}
+
+// EstimateQuality returns IJG quality (1-100) for which standard tables are
+// the closest to tables, as assigned to components by index (see JpegInfo).
+// It returns 0 if there are no tables.
+func EstimateQuality(tables []QuantTable, index []int) int {
+	if len(tables) == 0 {
+		return 0
+	}
+	lumaTable := &tables[0]
+	var chromaTable *QuantTable
+	if len(index) > 0 && index[0] < len(tables) {
+		lumaTable = &tables[index[0]]
+	}
+	if len(index) > 1 && index[1] < len(tables) {
+		chromaTable = &tables[index[1]]
+	}
+	best, bestDiff := 0, -1
+	for q := 1; q <= 100; q++ {
+		diff := quantTableDiff(lumaTable, scaleQuantTable(&StdLumaQuantTable, q))
+		if chromaTable != nil {
+			diff += quantTableDiff(chromaTable, scaleQuantTable(&StdChromaQuantTable, q))
+		}
+		if bestDiff < 0 || diff < bestDiff {
+			best, bestDiff = q, diff
+		}
+	}
+	return best
+}
+
+func quantTableDiff(t1 *QuantTable, t2 QuantTable) int {
+	diff := 0
+	for i, v := range t1 {
+		d := int(v) - int(t2[i])
+		if d < 0 {
+			d = -d
+		}
+		diff += d
+	}
+	return diff
+}
@@ -0,0 +1,23 @@
+/*
+Package register registers golibjpegturbo decoder for "jpeg" format with
+image package, so that image.Decode and image.DecodeConfig use libjpeg-turbo.
+
+It's opt-in, import it for side effects only:
+
+	import _ "github.com/kjk/golibjpegturbo/register"
+
+Note: image.Decode uses the first registered format that matches the data.
+If image/jpeg is also linked into the program and its init runs before this
+package's init, image/jpeg will still be used.
+*/
+package register
+
+import (
+	"image"
+
+	"github.com/kjk/golibjpegturbo"
+)
+
+func init() {
+	image.RegisterFormat("jpeg", "\xff\xd8", golibjpegturbo.Decode, golibjpegturbo.DecodeConfig)
+}
@@ -0,0 +1,193 @@
+package golibjpegturbo
+
+/*
+#include "jpeg_common.h"
+*/
+import "C"
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+// Scan describes one scan of a multi-scan (usually progressive) JPEG image.
+//
+// Components are indexes of components (0 is Y, 1 is Cb, 2 is Cr) coded in
+// the scan, in increasing order. Ss and Se are the first and last DCT
+// coefficient (0-63, in zig-zag order) in the scan i.e. spectral selection.
+// Ah and Al are successive approximation bit positions: Ah is the bit
+// position of the previous scan of those coefficients (0 for the first
+// scan) and Al is the bit position of this scan.
+type Scan struct {
+	Components []int
+	Ss, Se     int
+	Ah, Al     int
+}
+
+// ScanScript is a sequence of scans. If Options.ScanScript is not empty,
+// Encode uses it instead of jpeg_simple_progression() and Options.Progressive
+// is ignored.
+//
+// A script is progressive if any scan codes less than all 64 coefficients
+// or uses successive approximation. In that case DC and AC coefficients
+// can't be in the same scan, AC scans can only have one component and DC of
+// a component must be sent before its AC coefficients. Otherwise, each
+// component must be in exactly one scan.
+type ScanScript []Scan
+
+// maxAhAl is the maximum successive approximation bit position for 8-bit
+// samples
+const maxAhAl = 10
+
+// StandardScanScript returns the script used by jpeg_simple_progression()
+// for images with nComp components (1 or 3). It uses spectral selection and
+// successive approximation for a good balance of file size and quality of
+// early previews.
+func StandardScanScript(nComp int) ScanScript {
+	if nComp == 1 {
+		return ScanScript{
+			{[]int{0}, 0, 0, 0, 1},
+			{[]int{0}, 1, 5, 0, 2},
+			{[]int{0}, 6, 63, 0, 2},
+			{[]int{0}, 1, 63, 2, 1},
+			{[]int{0}, 0, 0, 1, 0},
+			{[]int{0}, 1, 63, 1, 0},
+		}
+	}
+	return ScanScript{
+		{[]int{0, 1, 2}, 0, 0, 0, 1},
+		{[]int{0}, 1, 5, 0, 2},
+		{[]int{2}, 1, 63, 0, 1},
+		{[]int{1}, 1, 63, 0, 1},
+		{[]int{0}, 6, 63, 0, 2},
+		{[]int{0}, 1, 63, 2, 1},
+		{[]int{0, 1, 2}, 0, 0, 1, 0},
+		{[]int{2}, 1, 63, 1, 0},
+		{[]int{1}, 1, 63, 1, 0},
+		{[]int{0}, 1, 63, 1, 0},
+	}
+}
+
+// SpectralScanScript returns a script for images with nComp components
+// (1 or 3) that only uses spectral selection: DC first, then low frequency
+// luma, chroma and remaining luma. It has fewer scans, so it decodes faster
+// and the first preview is shown early, but later previews are coarser than
+// with StandardScanScript.
+func SpectralScanScript(nComp int) ScanScript {
+	if nComp == 1 {
+		return ScanScript{
+			{[]int{0}, 0, 0, 0, 0},
+			{[]int{0}, 1, 5, 0, 0},
+			{[]int{0}, 6, 63, 0, 0},
+		}
+	}
+	return ScanScript{
+		{[]int{0, 1, 2}, 0, 0, 0, 0},
+		{[]int{0}, 1, 5, 0, 0},
+		{[]int{1}, 1, 63, 0, 0},
+		{[]int{2}, 1, 63, 0, 0},
+		{[]int{0}, 6, 63, 0, 0},
+	}
+}
+
+func (s ScanScript) isProgressive() bool {
+	for _, scan := range s {
+		if scan.Ss != 0 || scan.Se != 63 || scan.Ah != 0 || scan.Al != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// validate checks the script for an image with nComp components, following
+// the same rules as libjpeg
+func (s ScanScript) validate(nComp int) error {
+	progressive := s.isProgressive()
+	// for each component and coefficient, bit position of the last scan
+	// that coded it, -1 if not coded yet
+	lastBitPos := make([][64]int, nComp)
+	for i := range lastBitPos {
+		for j := range lastBitPos[i] {
+			lastBitPos[i][j] = -1
+		}
+	}
+	for i, scan := range s {
+		n := len(scan.Components)
+		if n < 1 || n > C.MAX_COMPS_IN_SCAN {
+			return fmt.Errorf("scan %d: invalid number of components %d", i, n)
+		}
+		for j, c := range scan.Components {
+			if c < 0 || c >= nComp {
+				return fmt.Errorf("scan %d: invalid component %d for image with %d components", i, c, nComp)
+			}
+			if j > 0 && c <= scan.Components[j-1] {
+				return fmt.Errorf("scan %d: components must be in increasing order", i)
+			}
+		}
+		if !progressive {
+			for _, c := range scan.Components {
+				if lastBitPos[c][0] == 0 {
+					return fmt.Errorf("scan %d: component %d already coded", i, c)
+				}
+				lastBitPos[c][0] = 0
+			}
+			continue
+		}
+		if scan.Ss < 0 || scan.Ss > 63 || scan.Se < scan.Ss || scan.Se > 63 {
+			return fmt.Errorf("scan %d: invalid spectral selection %d-%d", i, scan.Ss, scan.Se)
+		}
+		if scan.Ah < 0 || scan.Ah > maxAhAl || scan.Al < 0 || scan.Al > maxAhAl {
+			return fmt.Errorf("scan %d: invalid successive approximation %d, %d", i, scan.Ah, scan.Al)
+		}
+		if scan.Ss == 0 && scan.Se != 0 {
+			return fmt.Errorf("scan %d: DC and AC coefficients can't be in the same scan", i)
+		}
+		if scan.Ss != 0 && n != 1 {
+			return fmt.Errorf("scan %d: AC scan must have exactly one component", i)
+		}
+		for _, c := range scan.Components {
+			if scan.Ss != 0 && lastBitPos[c][0] < 0 {
+				return fmt.Errorf("scan %d: AC coefficients of component %d sent before DC", i, c)
+			}
+			for k := scan.Ss; k <= scan.Se; k++ {
+				last := lastBitPos[c][k]
+				if last < 0 {
+					if scan.Ah != 0 {
+						return fmt.Errorf("scan %d: first scan of coefficient %d of component %d must have Ah 0", i, k, c)
+					}
+				} else if scan.Ah != last || scan.Al != scan.Ah-1 {
+					return fmt.Errorf("scan %d: invalid successive approximation of coefficient %d of component %d", i, k, c)
+				}
+				lastBitPos[c][k] = scan.Al
+			}
+		}
+	}
+	for c := range lastBitPos {
+		if lastBitPos[c][0] < 0 {
+			return fmt.Errorf("component %d is not coded in any scan", c)
+		}
+	}
+	return nil
+}
+
+// install sets the script as cinfo's scan_info. It must be valid.
+func (s ScanScript) install(cinfo *C.struct_jpeg_compress_struct) error {
+	var p *C.jpeg_scan_info
+	if C.try_alloc_scan_info(cinfo, C.int(len(s)), &p) == 0 {
+		return jpegError(cinfo.err, PhaseEncode)
+	}
+	scans := unsafe.Slice(p, len(s))
+	for i, scan := range s {
+		scans[i].comps_in_scan = C.int(len(scan.Components))
+		for j, c := range scan.Components {
+			scans[i].component_index[j] = C.int(c)
+		}
+		scans[i].Ss = C.int(scan.Ss)
+		scans[i].Se = C.int(scan.Se)
+		scans[i].Ah = C.int(scan.Ah)
+		scans[i].Al = C.int(scan.Al)
+	}
+	cinfo.scan_info = p
+	cinfo.num_scans = C.int(len(s))
+	return nil
+}
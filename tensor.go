@@ -0,0 +1,217 @@
+package golibjpegturbo
+
+/*
+#include "jpeg_common.h"
+*/
+import "C"
+
+import (
+	"fmt"
+	"image"
+	"runtime"
+)
+
+// TensorLayout is the order of dimensions of a Tensor.
+type TensorLayout int
+
+const (
+	// LayoutHWC stores pixels row by row with interleaved channels, i.e.
+	// Data is indexed by [y][x][c]
+	LayoutHWC TensorLayout = iota
+	// LayoutCHW stores each channel as a separate plane, i.e. Data is
+	// indexed by [c][y][x]
+	LayoutCHW
+)
+
+// Tensor is an image decoded as normalized float32 values, as used by
+// machine learning models.
+type Tensor struct {
+	Data     []float32
+	Layout   TensorLayout
+	Width    int
+	Height   int
+	Channels int
+}
+
+// Shape returns the dimensions of t in the order of its layout.
+func (t *Tensor) Shape() []int {
+	if t.Layout == LayoutCHW {
+		return []int{t.Channels, t.Height, t.Width}
+	}
+	return []int{t.Height, t.Width, t.Channels}
+}
+
+// TensorOptions are the parameters for DecodeTensor.
+//
+// Decode are the options used for decoding, e.g. for DCT-domain scaling.
+// PixelFormat and YCbCr are ignored.
+//
+// Region, if not empty, is the part of the image to decode, like in
+// DecodeRegion.
+type TensorOptions struct {
+	Decode *DecodeOptions
+	Region image.Rectangle
+}
+
+// tensorRows is the number of scanlines decoded at a time
+const tensorRows = 16
+
+// tensorLUT returns the number of channels given by mean and std and
+// normalized values for every channel and sample value
+func tensorLUT(mean, std []float32) (int, [][256]float32, error) {
+	if mean == nil && std == nil {
+		mean, std = []float32{0, 0, 0}, []float32{1, 1, 1}
+	}
+	if len(mean) != len(std) || (len(mean) != 1 && len(mean) != 3) {
+		return 0, nil, fmt.Errorf("mean and std must both have 1 or 3 values, got %d and %d", len(mean), len(std))
+	}
+	lut := make([][256]float32, len(mean))
+	for c := range lut {
+		if std[c] == 0 {
+			return 0, nil, fmt.Errorf("std of channel %d is 0", c)
+		}
+		for v := range lut[c] {
+			lut[c][v] = (float32(v)/255 - mean[c]) / std[c]
+		}
+	}
+	return len(mean), lut, nil
+}
+
+// DecodeTensor decodes JPEG image d to a Tensor with the given layout.
+//
+// The number of channels is the number of values in mean and std: 3 for
+// RGB or 1 for grayscale (color images are converted). Values are
+// (v/255 - mean[c]) / std[c] for sample v of channel c. If mean and std
+// are nil, the tensor is RGB with values from 0 to 1.
+//
+// Scanlines are converted as they are decoded, without decoding the whole
+// image first.
+func DecodeTensor(d []byte, layout TensorLayout, mean, std []float32, o *TensorOptions) (*Tensor, error) {
+	dec, err := NewDecoder()
+	if err != nil {
+		return nil, err
+	}
+	defer dec.Close()
+	return dec.DecodeTensor(d, layout, mean, std, o)
+}
+
+// DecodeTensor decodes JPEG image d to a Tensor, like the package-level
+// DecodeTensor.
+func (dec *Decoder) DecodeTensor(d []byte, layout TensorLayout, mean, std []float32, o *TensorOptions) (*Tensor, error) {
+	if layout != LayoutHWC && layout != LayoutCHW {
+		return nil, fmt.Errorf("invalid tensor layout %d", layout)
+	}
+	channels, lut, err := tensorLUT(mean, std)
+	if err != nil {
+		return nil, err
+	}
+	var do *DecodeOptions
+	var region image.Rectangle
+	if o != nil {
+		do, region = o.Decode, o.Region
+	}
+
+	cinfo := dec.cinfo
+	defer dec.reset()
+
+	var pinner runtime.Pinner
+	defer pinner.Unpin()
+	if err := memSrc(cinfo, d, &pinner); err != nil {
+		return nil, err
+	}
+	if err := readHeader(cinfo, do); err != nil {
+		return nil, err
+	}
+	nComp, err := numComponents(cinfo)
+	if err != nil {
+		return nil, err
+	}
+	bounds := image.Rect(0, 0, int(cinfo.output_width), int(cinfo.output_height))
+	r := bounds
+	if !region.Empty() {
+		if err := checkRegion(cinfo, region); err != nil {
+			return nil, err
+		}
+		r = region
+	}
+
+	// libjpeg can't convert CMYK, it's converted in Go
+	switch {
+	case nComp == 4:
+		cinfo.out_color_space = C.JCS_CMYK
+	case channels == 1:
+		cinfo.out_color_space = C.JCS_GRAYSCALE
+	default:
+		cinfo.out_color_space = C.JCS_EXT_RGB
+	}
+	if C.try_start_decompress(cinfo) == 0 {
+		return nil, jpegError(cinfo.err, PhaseDecompress)
+	}
+	x0 := 0
+	if r != bounds {
+		if x0, err = startRegion(cinfo, r); err != nil {
+			return nil, err
+		}
+	}
+
+	dx, dy := r.Dx(), r.Dy()
+	t := &Tensor{
+		Data:     make([]float32, dx*dy*channels),
+		Layout:   layout,
+		Width:    dx,
+		Height:   dy,
+		Channels: channels,
+	}
+	// distance between values of adjacent pixels and channels
+	pixStep, chanStep := channels, 1
+	if layout == LayoutCHW {
+		pixStep, chanStep = 1, dx*dy
+	}
+	nOut := int(cinfo.output_components)
+	stride := int(cinfo.output_width) * nOut
+	rows := make([]byte, stride*tensorRows)
+	for y := 0; y < dy; {
+		n := min(tensorRows, dy-y)
+		if err := readRows(cinfo, rows, stride, n, &dec.buf); err != nil {
+			return nil, err
+		}
+		for i := 0; i < n; i++ {
+			row := rows[i*stride+x0*nOut : i*stride+(x0+dx)*nOut]
+			dst := t.Data[(y+i)*dx*pixStep:]
+			if nComp == 4 {
+				cmykToTensor(dst, row, cmykInverted(cinfo), lut, pixStep, chanStep)
+				continue
+			}
+			for x := 0; x < dx; x++ {
+				p := row[x*nOut:]
+				for c := 0; c < channels; c++ {
+					dst[x*pixStep+c*chanStep] = lut[c][p[c]]
+				}
+			}
+		}
+		y += n
+	}
+
+	if cinfo.output_scanline == cinfo.output_height {
+		if C.try_finish_decompress(cinfo) == 0 {
+			return nil, jpegError(cinfo.err, PhaseDecompress)
+		}
+	}
+	return t, nil
+}
+
+// cmykToTensor converts a row of CMYK pixels to RGB (like cmykToRgba) or
+// luma and stores normalized values in dst
+func cmykToTensor(dst []float32, row []byte, inverted bool, lut [][256]float32, pixStep, chanStep int) {
+	for x := 0; x < len(row)/4; x++ {
+		p := row[x*4 : x*4+4]
+		r, g, b := cmykToRGB(p[0], p[1], p[2], p[3], inverted)
+		if len(lut) == 1 {
+			dst[x*pixStep] = lut[0][rgbToGray(r, g, b)]
+			continue
+		}
+		dst[x*pixStep] = lut[0][r]
+		dst[x*pixStep+chanStep] = lut[1][g]
+		dst[x*pixStep+2*chanStep] = lut[2][b]
+	}
+}
@@ -0,0 +1,289 @@
+package golibjpegturbo
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"math"
+)
+
+// ResampleFilter is the filter used for resampling an image to its final
+// size after DCT-domain scaling.
+type ResampleFilter int
+
+const (
+	// Lanczos3 is sharpest but slowest
+	Lanczos3 ResampleFilter = iota
+	// CatmullRom is a bit softer than Lanczos3 but faster
+	CatmullRom
+)
+
+// ThumbnailOptions are the parameters for Thumbnail and EncodeThumbnail.
+// Encode are the options used by EncodeThumbnail, default parameters are
+// used if it's nil.
+type ThumbnailOptions struct {
+	Filter ResampleFilter
+	Encode *Options
+}
+
+// support returns the radius of the filter
+func (f ResampleFilter) support() float64 {
+	if f == CatmullRom {
+		return 2
+	}
+	return 3
+}
+
+func (f ResampleFilter) kernel(x float64) float64 {
+	if x < 0 {
+		x = -x
+	}
+	if f == CatmullRom {
+		if x < 1 {
+			return (1.5*x-2.5)*x*x + 1
+		}
+		if x < 2 {
+			return ((-0.5*x+2.5)*x-4)*x + 2
+		}
+		return 0
+	}
+	if x == 0 {
+		return 1
+	}
+	if x < 3 {
+		px := math.Pi * x
+		return 3 * math.Sin(px) * math.Sin(px/3) / (px * px)
+	}
+	return 0
+}
+
+// thumbnailSize returns the size of an image dx x dy scaled down to fit
+// within maxW x maxH, preserving aspect ratio. Images are never scaled up.
+func thumbnailSize(dx, dy, maxW, maxH int) (int, int) {
+	if dx <= maxW && dy <= maxH {
+		return dx, dy
+	}
+	var tw, th int
+	if dx*maxH > dy*maxW {
+		tw = maxW
+		th = int(math.Floor(float64(dy)*float64(maxW)/float64(dx) + 0.5))
+	} else {
+		th = maxH
+		tw = int(math.Floor(float64(dx)*float64(maxH)/float64(dy) + 0.5))
+	}
+	if tw < 1 {
+		tw = 1
+	}
+	if th < 1 {
+		th = 1
+	}
+	return tw, th
+}
+
+// Thumbnail decodes JPEG image d scaled down to fit within maxW x maxH,
+// preserving aspect ratio.
+//
+// The image is decoded with the largest DCT-domain scaling (see DecodeOptions)
+// that still keeps it at least as big as the thumbnail, and then resampled
+// to the exact size with o.Filter in linear light (i.e. gamma-aware).
+// Images that already fit are not scaled up.
+func Thumbnail(d []byte, maxW, maxH int, o *ThumbnailOptions) (image.Image, error) {
+	if maxW <= 0 || maxH <= 0 {
+		return nil, fmt.Errorf("invalid thumbnail size %dx%d (both must be > 0)", maxW, maxH)
+	}
+	filter := Lanczos3
+	if o != nil {
+		filter = o.Filter
+	}
+	if filter != Lanczos3 && filter != CatmullRom {
+		return nil, fmt.Errorf("invalid resample filter %d", filter)
+	}
+	info, err := GetJpegInfo(d)
+	if err != nil {
+		return nil, err
+	}
+	tw, th := thumbnailSize(info.Width, info.Height, maxW, maxH)
+	img, err := DecodeDataWithOptions(d, &DecodeOptions{MinWidth: tw, MinHeight: th})
+	if err != nil {
+		return nil, err
+	}
+	return resample(img, tw, th, filter), nil
+}
+
+// EncodeThumbnail creates a thumbnail of JPEG image d, like Thumbnail, and
+// writes it to w as JPEG encoded with o.Encode options.
+func EncodeThumbnail(w io.Writer, d []byte, maxW, maxH int, o *ThumbnailOptions) error {
+	img, err := Thumbnail(d, maxW, maxH, o)
+	if err != nil {
+		return err
+	}
+	var eo *Options
+	if o != nil {
+		eo = o.Encode
+	}
+	return Encode(w, img, eo)
+}
+
+var (
+	srgbToLinearTable [256]float32
+	// indexed by linear value scaled to 0..linearToSrgbSize-1
+	linearToSrgbTable [linearToSrgbSize]uint8
+)
+
+const linearToSrgbSize = 4096
+
+func init() {
+	for i := range srgbToLinearTable {
+		v := float64(i) / 255
+		if v <= 0.04045 {
+			v = v / 12.92
+		} else {
+			v = math.Pow((v+0.055)/1.055, 2.4)
+		}
+		srgbToLinearTable[i] = float32(v)
+	}
+	for i := range linearToSrgbTable {
+		v := float64(i) / (linearToSrgbSize - 1)
+		if v <= 0.0031308 {
+			v = v * 12.92
+		} else {
+			v = 1.055*math.Pow(v, 1/2.4) - 0.055
+		}
+		linearToSrgbTable[i] = uint8(math.Floor(v*255 + 0.5))
+	}
+}
+
+func linearToSrgb(v float32) uint8 {
+	if v <= 0 {
+		return 0
+	}
+	if v >= 1 {
+		return 255
+	}
+	return linearToSrgbTable[int(v*(linearToSrgbSize-1)+0.5)]
+}
+
+// contrib are weights of source pixels starting at start contributing to
+// a single destination pixel
+type contrib struct {
+	start   int
+	weights []float32
+}
+
+func makeContribs(srcSize, dstSize int, f ResampleFilter) []contrib {
+	scale := float64(srcSize) / float64(dstSize)
+	// when downsampling, the filter is stretched to cover more source pixels
+	fscale := math.Max(scale, 1)
+	support := f.support() * fscale
+	res := make([]contrib, dstSize)
+	for i := range res {
+		center := (float64(i) + 0.5) * scale
+		start := int(math.Floor(center - support))
+		if start < 0 {
+			start = 0
+		}
+		end := int(math.Ceil(center + support))
+		if end > srcSize {
+			end = srcSize
+		}
+		weights := make([]float32, end-start)
+		var sum float64
+		for j := start; j < end; j++ {
+			w := f.kernel((float64(j) + 0.5 - center) / fscale)
+			weights[j-start] = float32(w)
+			sum += w
+		}
+		if sum != 0 {
+			for j := range weights {
+				weights[j] = float32(float64(weights[j]) / sum)
+			}
+		}
+		res[i] = contrib{start: start, weights: weights}
+	}
+	return res
+}
+
+// resample returns img resized to dx x dy. img must be *image.RGBA or
+// *image.Gray (i.e. what we decode to), the result is of the same type.
+// Color components are resampled in linear light, alpha as is.
+func resample(img image.Image, dx, dy int, f ResampleFilter) image.Image {
+	b := img.Bounds()
+	if b.Dx() == dx && b.Dy() == dy {
+		return img
+	}
+	var pix []uint8
+	var stride, nComp int
+	switch v := img.(type) {
+	case *image.RGBA:
+		pix, stride, nComp = v.Pix, v.Stride, 4
+	case *image.Gray:
+		pix, stride, nComp = v.Pix, v.Stride, 1
+	default:
+		panic(fmt.Sprintf("unsupported image type %T", img))
+	}
+	srcDx, srcDy := b.Dx(), b.Dy()
+	hContribs := makeContribs(srcDx, dx, f)
+	vContribs := makeContribs(srcDy, dy, f)
+
+	// horizontal pass, from source pixels to linear values
+	tmp := make([]float32, dx*srcDy*nComp)
+	line := make([]float32, srcDx*nComp)
+	for y := 0; y < srcDy; y++ {
+		row := pix[y*stride : y*stride+srcDx*nComp]
+		for i, v := range row {
+			if nComp == 4 && i%4 == 3 {
+				line[i] = float32(v) / 255
+			} else {
+				line[i] = srgbToLinearTable[v]
+			}
+		}
+		dst := tmp[y*dx*nComp:]
+		for x, c := range hContribs {
+			for ci := 0; ci < nComp; ci++ {
+				var sum float32
+				off := c.start*nComp + ci
+				for _, w := range c.weights {
+					sum += w * line[off]
+					off += nComp
+				}
+				dst[x*nComp+ci] = sum
+			}
+		}
+	}
+
+	// vertical pass, from linear values to destination pixels
+	var res image.Image
+	var dstPix []uint8
+	var dstStride int
+	if nComp == 4 {
+		m := image.NewRGBA(image.Rect(0, 0, dx, dy))
+		res, dstPix, dstStride = m, m.Pix, m.Stride
+	} else {
+		m := image.NewGray(image.Rect(0, 0, dx, dy))
+		res, dstPix, dstStride = m, m.Pix, m.Stride
+	}
+	tmpStride := dx * nComp
+	for y, c := range vContribs {
+		dst := dstPix[y*dstStride:]
+		for i := 0; i < tmpStride; i++ {
+			var sum float32
+			off := c.start*tmpStride + i
+			for _, w := range c.weights {
+				sum += w * tmp[off]
+				off += tmpStride
+			}
+			if nComp == 4 && i%4 == 3 {
+				v := sum*255 + 0.5
+				if v < 0 {
+					v = 0
+				} else if v > 255 {
+					v = 255
+				}
+				dst[i] = uint8(v)
+			} else {
+				dst[i] = linearToSrgb(sum)
+			}
+		}
+	}
+	return res
+}
@@ -0,0 +1,167 @@
+package golibjpegturbo
+
+/*
+#include "jpeg_common.h"
+*/
+import "C"
+
+import (
+	"image"
+	"unsafe"
+)
+
+// ycbcrRatios maps horizontal and vertical ratio of luma to chroma sampling
+// to Go's subsample ratio
+var ycbcrRatios = map[[2]int]image.YCbCrSubsampleRatio{
+	{1, 1}: image.YCbCrSubsampleRatio444,
+	{2, 1}: image.YCbCrSubsampleRatio422,
+	{2, 2}: image.YCbCrSubsampleRatio420,
+	{1, 2}: image.YCbCrSubsampleRatio440,
+	{4, 1}: image.YCbCrSubsampleRatio411,
+	{4, 2}: image.YCbCrSubsampleRatio410,
+}
+
+// ycbcrRatio returns the subsample ratio of YCbCr image being decoded, or
+// false if it's not YCbCr or its components can't be represented by
+// image.YCbCr. Output dimensions must have been calculated.
+//
+// When scaling, libjpeg can scale chroma components less than luma instead
+// of upsampling them, so the ratio is of the scaled sizes.
+func ycbcrRatio(cinfo *C.struct_jpeg_decompress_struct) (image.YCbCrSubsampleRatio, bool) {
+	if cinfo.jpeg_color_space != C.JCS_YCbCr || cinfo.num_components != 3 {
+		return 0, false
+	}
+	comps := unsafe.Slice(cinfo.comp_info, 3)
+	y, cb, cr := &comps[0], &comps[1], &comps[2]
+	if cb.h_samp_factor != cr.h_samp_factor || cb.v_samp_factor != cr.v_samp_factor ||
+		C.comp_h_scaled_size(cb) != C.comp_h_scaled_size(cr) || C.comp_v_scaled_size(cb) != C.comp_v_scaled_size(cr) {
+		return 0, false
+	}
+	yh, yv := int(y.h_samp_factor*C.comp_h_scaled_size(y)), int(y.v_samp_factor*C.comp_v_scaled_size(y))
+	ch, cv := int(cb.h_samp_factor*C.comp_h_scaled_size(cb)), int(cb.v_samp_factor*C.comp_v_scaled_size(cb))
+	if yh%ch != 0 || yv%cv != 0 {
+		return 0, false
+	}
+	ratio, ok := ycbcrRatios[[2]int{yh / ch, yv / cv}]
+	return ratio, ok
+}
+
+// planeSize returns the stride and height of a plane for component comp
+// that has room for whole iMCU rows
+func planeSize(cinfo *C.struct_jpeg_decompress_struct, comp *C.jpeg_component_info) (int, int) {
+	stride := int(comp.width_in_blocks) * int(C.comp_h_scaled_size(comp))
+	height := int(cinfo.total_iMCU_rows) * int(comp.v_samp_factor*C.comp_v_scaled_size(comp))
+	return stride, height
+}
+
+// decodeYCbCr decodes YCbCr image as is, without upsampling and color
+// conversion. The header must have been read and ratio is from ycbcrRatio.
+func decodeYCbCr(cinfo *C.struct_jpeg_decompress_struct, ratio image.YCbCrSubsampleRatio) (*image.YCbCr, error) {
+	cinfo.out_color_space = C.JCS_YCbCr
+	cinfo.raw_data_out = C.TRUE
+	if C.try_start_decompress(cinfo) == 0 {
+		return nil, jpegError(cinfo.err, PhaseDecompress)
+	}
+
+	// libjpeg writes whole blocks so planes are a bit bigger than the image
+	comps := unsafe.Slice(cinfo.comp_info, 3)
+	yStride, yHeight := planeSize(cinfo, &comps[0])
+	cStride, cHeight := planeSize(cinfo, &comps[1])
+	img := &image.YCbCr{
+		Y:              make([]byte, yStride*yHeight),
+		Cb:             make([]byte, cStride*cHeight),
+		Cr:             make([]byte, cStride*cHeight),
+		YStride:        yStride,
+		CStride:        cStride,
+		SubsampleRatio: ratio,
+		Rect:           image.Rect(0, 0, int(cinfo.output_width), int(cinfo.output_height)),
+	}
+	if C.try_read_raw_ycbcr(cinfo, (*C.JSAMPLE)(&img.Y[0]), (*C.JSAMPLE)(&img.Cb[0]), (*C.JSAMPLE)(&img.Cr[0]), C.int(yStride), C.int(cStride)) == 0 {
+		return nil, jpegError(cinfo.err, PhaseDecompress)
+	}
+	return img, nil
+}
+
+// rawSource returns luma sampling factors of m and a function that fills
+// row with row y of component ci of m, if m can be given to libjpeg as raw
+// YCbCr data. That's *image.YCbCr, if it's encoded in YCbCr color space,
+// its subsampling is supported and its bounds are aligned to chroma
+// samples, and YUV frames.
+func rawSource(m image.Image, o *Options) ([2]int, func(ci, y int, row []byte), bool) {
+	if o.ColorSpace == ColorSpaceRGB {
+		return [2]int{}, nil, false
+	}
+	switch m := m.(type) {
+	case *image.YCbCr:
+		for f, ratio := range ycbcrRatios {
+			if ratio != m.SubsampleRatio {
+				continue
+			}
+			b := m.Bounds()
+			if b.Min.X%f[0] != 0 || b.Min.Y%f[1] != 0 {
+				break
+			}
+			return f, func(ci, y int, row []byte) {
+				if ci == 0 {
+					i := m.YOffset(b.Min.X, b.Min.Y+y)
+					copy(row, m.Y[i:])
+					return
+				}
+				i := m.COffset(b.Min.X, b.Min.Y+y*f[1])
+				if ci == 1 {
+					copy(row, m.Cb[i:])
+				} else {
+					copy(row, m.Cr[i:])
+				}
+			}, true
+		}
+	case *yuvImage:
+		return m.factors(), m.row, true
+	}
+	return [2]int{}, nil, false
+}
+
+// setRawYCbCr makes cinfo take raw YCbCr data sampled with luma factors f
+func setRawYCbCr(cinfo *C.struct_jpeg_compress_struct, f [2]int) {
+	comps := compInfo(cinfo)
+	comps[0].h_samp_factor = C.int(f[0])
+	comps[0].v_samp_factor = C.int(f[1])
+	for i := 1; i < len(comps); i++ {
+		comps[i].h_samp_factor = 1
+		comps[i].v_samp_factor = 1
+	}
+	cinfo.raw_data_in = C.TRUE
+}
+
+// writeRawYCbCr writes rows of components returned by fill (see rawSource)
+// one iMCU row at a time. libjpeg only takes whole blocks, so components
+// are padded by replicating the last column and row.
+func writeRawYCbCr(cinfo *C.struct_jpeg_compress_struct, fill func(ci, y int, row []byte), lb *lineBuffer) error {
+	comps := compInfo(cinfo)
+	size := 0
+	for _, comp := range comps {
+		size += int(comp.width_in_blocks) * C.DCTSIZE * int(comp.v_samp_factor) * C.DCTSIZE
+	}
+	p := lb.get(size)
+	buf := sliceFromCBytes(p, size)
+	for imcu := 0; imcu < int(cinfo.total_iMCU_rows); imcu++ {
+		off := 0
+		for ci, comp := range comps {
+			width := int(comp.width_in_blocks) * C.DCTSIZE
+			nRows := int(comp.v_samp_factor) * C.DCTSIZE
+			dx, dy := int(comp.downsampled_width), int(comp.downsampled_height)
+			for r := 0; r < nRows; r++ {
+				row := buf[off : off+width]
+				fill(ci, min(imcu*nRows+r, dy-1), row[:dx])
+				for x := dx; x < width; x++ {
+					row[x] = row[dx-1]
+				}
+				off += width
+			}
+		}
+		if C.try_write_raw_imcu_row(cinfo, (*C.JSAMPLE)(p)) == 0 {
+			return jpegError(cinfo.err, PhaseEncode)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,278 @@
+package golibjpegturbo
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+)
+
+// YUVFormat is the memory layout of a YUV frame, as used by cameras and
+// video codecs.
+//
+// Samples are JPEG's full range YCbCr and are used as they are, i.e. frames
+// in limited (video) range are not converted. Chroma dimensions are
+// rounded up, so for odd width or height the last chroma sample covers
+// a single column or row.
+type YUVFormat int
+
+const (
+	// I420 is 4:2:0 with 3 planes: Y, U (Cb) and V (Cr)
+	I420 YUVFormat = iota
+	// NV12 is 4:2:0 with 2 planes: Y and interleaved U and V
+	NV12
+	// YUYV is 4:2:2 with a single plane of Y0 U Y1 V for every 2 pixels.
+	// For odd width Y1 of the last pair is padding.
+	YUYV
+)
+
+func (f YUVFormat) String() string {
+	switch f {
+	case I420:
+		return "I420"
+	case NV12:
+		return "NV12"
+	case YUYV:
+		return "YUYV"
+	}
+	return fmt.Sprintf("YUVFormat(%d)", int(f))
+}
+
+// YUVPlane is a plane of YUV frame. Rows of the plane are Stride bytes
+// apart, so rows can be padded. Stride must be at least the size of a row
+// and Data must hold all rows, except that the last row doesn't need
+// padding.
+//
+// Sizes of rows (in bytes) and the number of rows for frame of width x
+// height, with cw = (width+1)/2 and ch = (height+1)/2, are:
+//
+//	I420: Y: width x height, U and V: cw x ch
+//	NV12: Y: width x height, UV: 2*cw x ch
+//	YUYV: 4*cw x height
+type YUVPlane struct {
+	Data   []byte
+	Stride int
+}
+
+func (f YUVFormat) validate() error {
+	if f < I420 || f > YUYV {
+		return fmt.Errorf("invalid YUV format %d", f)
+	}
+	return nil
+}
+
+// planeSizes returns the size of a row and the number of rows of each plane
+// of width x height frame
+func (f YUVFormat) planeSizes(width, height int) [][2]int {
+	cw, ch := (width+1)/2, (height+1)/2
+	switch f {
+	case I420:
+		return [][2]int{{width, height}, {cw, ch}, {cw, ch}}
+	case NV12:
+		return [][2]int{{width, height}, {2 * cw, ch}}
+	}
+	return [][2]int{{4 * cw, height}}
+}
+
+// yuvImage is a YUV frame as an image, which Encode gives to libjpeg as raw
+// data (see rawSource)
+type yuvImage struct {
+	planes        []YUVPlane
+	format        YUVFormat
+	width, height int
+}
+
+func (m *yuvImage) ColorModel() color.Model {
+	return color.YCbCrModel
+}
+
+func (m *yuvImage) Bounds() image.Rectangle {
+	return image.Rect(0, 0, m.width, m.height)
+}
+
+func (m *yuvImage) At(x, y int) color.Color {
+	if !image.Pt(x, y).In(m.Bounds()) {
+		return color.YCbCr{}
+	}
+	cx := x / 2
+	switch m.format {
+	case I420:
+		cy := y / 2
+		return color.YCbCr{
+			Y:  m.planes[0].Data[y*m.planes[0].Stride+x],
+			Cb: m.planes[1].Data[cy*m.planes[1].Stride+cx],
+			Cr: m.planes[2].Data[cy*m.planes[2].Stride+cx],
+		}
+	case NV12:
+		uv := m.planes[1].Data[y/2*m.planes[1].Stride+cx*2:]
+		return color.YCbCr{Y: m.planes[0].Data[y*m.planes[0].Stride+x], Cb: uv[0], Cr: uv[1]}
+	default:
+		p := m.planes[0].Data[y*m.planes[0].Stride+cx*4:]
+		return color.YCbCr{Y: p[x%2*2], Cb: p[1], Cr: p[3]}
+	}
+}
+
+// factors returns luma sampling factors of the frame
+func (m *yuvImage) factors() [2]int {
+	if m.format == YUYV {
+		return [2]int{2, 1}
+	}
+	return [2]int{2, 2}
+}
+
+// row fills row with row y of component ci
+func (m *yuvImage) row(ci, y int, row []byte) {
+	switch {
+	case m.format == YUYV:
+		p := m.planes[0].Data[y*m.planes[0].Stride:]
+		if ci == 0 {
+			for x := range row {
+				row[x] = p[x*2]
+			}
+			return
+		}
+		for x := range row {
+			row[x] = p[x*4+ci*2-1]
+		}
+	case ci == 0 || m.format == I420:
+		copy(row, m.planes[ci].Data[y*m.planes[ci].Stride:])
+	default:
+		p := m.planes[1].Data[y*m.planes[1].Stride:]
+		for x := range row {
+			row[x] = p[x*2+ci-1]
+		}
+	}
+}
+
+// EncodeYUV writes width x height YUV frame with the given planes to w in
+// JPEG format with the given options, like Encode. The frame is given to
+// libjpeg as it is, so Subsampling is ignored, unless RGB color space is
+// requested.
+func EncodeYUV(w io.Writer, planes []YUVPlane, format YUVFormat, width, height int, o *Options) error {
+	if err := format.validate(); err != nil {
+		return err
+	}
+	if width <= 0 || height <= 0 {
+		return fmt.Errorf("%w: frame with invalid size %dx%d (both must be > 0)", ErrInvalidDimensions, width, height)
+	}
+	sizes := format.planeSizes(width, height)
+	if len(planes) != len(sizes) {
+		return fmt.Errorf("%v frame must have %d planes, got %d", format, len(sizes), len(planes))
+	}
+	for i, p := range planes {
+		rowSize, rows := sizes[i][0], sizes[i][1]
+		if p.Stride < rowSize {
+			return fmt.Errorf("stride %d of %v plane %d is smaller than the row size %d", p.Stride, format, i, rowSize)
+		}
+		if n := (rows-1)*p.Stride + rowSize; len(p.Data) < n {
+			return fmt.Errorf("%v plane %d has %d bytes, need %d", format, i, len(p.Data), n)
+		}
+	}
+	return Encode(w, &yuvImage{planes: planes, format: format, width: width, height: height}, o)
+}
+
+// DecodeToYUV decodes JPEG image d to a YUV frame in format and returns its
+// planes and size. Planes are not padded, i.e. their strides are the sizes
+// of rows (see YUVPlane).
+//
+// YCbCr images with matching subsampling are decoded without color
+// conversion and chroma resampling, other images are converted and their
+// chroma is averaged.
+func DecodeToYUV(d []byte, format YUVFormat) (planes []YUVPlane, width, height int, err error) {
+	if err := format.validate(); err != nil {
+		return nil, 0, 0, err
+	}
+	img, err := DecodeDataWithOptions(d, &DecodeOptions{YCbCr: true})
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	b := img.Bounds()
+	width, height = b.Dx(), b.Dy()
+	sizes := format.planeSizes(width, height)
+
+	// planes of the frame as I420 (or I422 for YUYV)
+	f := [2]int{2, 2}
+	ratio := image.YCbCrSubsampleRatio420
+	if format == YUYV {
+		f, ratio = [2]int{2, 1}, image.YCbCrSubsampleRatio422
+	}
+	m, ok := img.(*image.YCbCr)
+	if !ok || m.SubsampleRatio != ratio {
+		m = toYCbCr(img, f, ratio)
+	}
+
+	cw, ch := (width+1)/2, (height+f[1]-1)/f[1]
+	for _, s := range sizes {
+		planes = append(planes, YUVPlane{Data: make([]byte, s[0]*s[1]), Stride: s[0]})
+	}
+	switch format {
+	case I420:
+		for y := 0; y < height; y++ {
+			copy(planes[0].Data[y*width:(y+1)*width], m.Y[y*m.YStride:])
+		}
+		for y := 0; y < ch; y++ {
+			copy(planes[1].Data[y*cw:(y+1)*cw], m.Cb[y*m.CStride:])
+			copy(planes[2].Data[y*cw:(y+1)*cw], m.Cr[y*m.CStride:])
+		}
+	case NV12:
+		for y := 0; y < height; y++ {
+			copy(planes[0].Data[y*width:(y+1)*width], m.Y[y*m.YStride:])
+		}
+		for y := 0; y < ch; y++ {
+			uv := planes[1].Data[y*cw*2:]
+			for x := 0; x < cw; x++ {
+				uv[x*2] = m.Cb[y*m.CStride+x]
+				uv[x*2+1] = m.Cr[y*m.CStride+x]
+			}
+		}
+	case YUYV:
+		for y := 0; y < height; y++ {
+			p := planes[0].Data[y*cw*4:]
+			for x := 0; x < width; x++ {
+				p[x*2] = m.Y[y*m.YStride+x]
+			}
+			for x := 0; x < cw; x++ {
+				p[x*4+1] = m.Cb[y*m.CStride+x]
+				p[x*4+3] = m.Cr[y*m.CStride+x]
+			}
+		}
+	}
+	return planes, width, height, nil
+}
+
+// toYCbCr converts img to YCbCr with ratio, whose luma sampling factors
+// are f. Chroma samples are averages of the pixels they cover.
+func toYCbCr(img image.Image, f [2]int, ratio image.YCbCrSubsampleRatio) *image.YCbCr {
+	b := img.Bounds()
+	dx, dy := b.Dx(), b.Dy()
+	m := image.NewYCbCr(image.Rect(0, 0, dx, dy), ratio)
+	cb := make([]int, dx)
+	cr := make([]int, dx)
+	for y := 0; y < dy; y++ {
+		for x := 0; x < dx; x++ {
+			c := color.YCbCrModel.Convert(img.At(b.Min.X+x, b.Min.Y+y)).(color.YCbCr)
+			m.Y[m.YOffset(x, y)] = c.Y
+			cb[x] += int(c.Cb)
+			cr[x] += int(c.Cr)
+		}
+		if y%f[1] != f[1]-1 && y != dy-1 {
+			continue
+		}
+		// last row of chroma samples
+		rows := y%f[1] + 1
+		for cx := 0; cx*f[0] < dx; cx++ {
+			var sumCb, sumCr, n int
+			for x := cx * f[0]; x < min((cx+1)*f[0], dx); x++ {
+				sumCb += cb[x]
+				sumCr += cr[x]
+				n += rows
+			}
+			i := m.COffset(cx*f[0], y)
+			m.Cb[i] = uint8((sumCb + n/2) / n)
+			m.Cr[i] = uint8((sumCr + n/2) / n)
+		}
+		clear(cb)
+		clear(cr)
+	}
+	return m
+}